@@ -0,0 +1,273 @@
+package exportedservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// ListEncoding selects how the list of addresses in an aggregated key is
+// encoded.
+type ListEncoding int
+
+const (
+	// NewlineList encodes the addresses one per line.
+	NewlineList ListEncoding = iota
+
+	// JSONList encodes the addresses as a JSON array of strings.
+	JSONList
+)
+
+// ErrAggregateConflict is returned when an aggregated key could not be
+// updated because it was modified concurrently too many times in a row.
+var ErrAggregateConflict = errors.New(
+	"aggregated key modified concurrently too often")
+
+// aggregateMaxAttempts is the number of attempts made at updating an
+// aggregated key before giving up with ErrAggregateConflict.
+const aggregateMaxAttempts = 10
+
+// aggregateEntry records the addresses added to an aggregated key.
+type aggregateEntry struct {
+	addrs    map[string]bool
+	encoding ListEncoding
+}
+
+/*
+AddToAggregatedKey adds "addr" to the list of addresses stored in the single
+etcd key "key", for consumers which expect all instances of a service in one
+key rather than one key per instance. The key is updated with a compare and
+swap transaction, which is retried if other instances modify the key at the
+same time. Nothing is changed if the address is already in the list.
+
+Since the key is shared between instances, it can't be bound to the lease of
+any of them. The address is removed again by RemoveFromAggregatedKey,
+DeregisterAll or Close, but it remains in the list if the process dies
+without calling either.
+*/
+func (e *ServiceExporter) AddToAggregatedKey(
+	ctx context.Context, key string, enc ListEncoding, addr string) error {
+	var err error
+
+	err = e.updateAggregatedKey(ctx, key, enc,
+		func(addrs []string) []string {
+			var a string
+
+			for _, a = range addrs {
+				if a == addr {
+					return addrs
+				}
+			}
+			return append(addrs, addr)
+		})
+	if err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	if e.aggregated == nil {
+		e.aggregated = make(map[string]*aggregateEntry)
+	}
+	if e.aggregated[key] == nil {
+		e.aggregated[key] = &aggregateEntry{addrs: make(map[string]bool)}
+	}
+	e.aggregated[key].addrs[addr] = true
+	e.aggregated[key].encoding = enc
+	e.mtx.Unlock()
+
+	e.logf("exportedservice: added %s to aggregated key %s", addr, key)
+
+	return nil
+}
+
+/*
+RemoveFromAggregatedKey removes "addr" from the list of addresses stored in
+the etcd key "key", using a compare and swap transaction like
+AddToAggregatedKey. The key is deleted once the list is empty.
+*/
+func (e *ServiceExporter) RemoveFromAggregatedKey(
+	ctx context.Context, key string, enc ListEncoding, addr string) error {
+	var err error
+
+	if err = e.removeFromAggregatedKey(ctx, key, enc, addr); err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	if e.aggregated[key] != nil {
+		delete(e.aggregated[key].addrs, addr)
+		if len(e.aggregated[key].addrs) == 0 {
+			delete(e.aggregated, key)
+		}
+	}
+	e.mtx.Unlock()
+
+	return nil
+}
+
+/*
+removeFromAggregatedKey removes "addr" from the list stored in "key" without
+touching the bookkeeping of the exporter.
+*/
+func (e *ServiceExporter) removeFromAggregatedKey(
+	ctx context.Context, key string, enc ListEncoding, addr string) error {
+	var err error
+
+	err = e.updateAggregatedKey(ctx, key, enc,
+		func(addrs []string) []string {
+			var rv []string
+			var a string
+
+			for _, a = range addrs {
+				if a != addr {
+					rv = append(rv, a)
+				}
+			}
+			return rv
+		})
+	if err != nil {
+		return err
+	}
+
+	e.logf("exportedservice: removed %s from aggregated key %s", addr, key)
+
+	return nil
+}
+
+/*
+removeAllAggregated removes all addresses added through AddToAggregatedKey
+from their keys. The lock must not be held, as it is only taken to find the
+addresses, not while talking to etcd.
+*/
+func (e *ServiceExporter) removeAllAggregated(ctx context.Context) error {
+	var pending = make(map[string]*aggregateEntry)
+	var entry *aggregateEntry
+	var key, addr string
+	var err, rerr error
+
+	e.mtx.Lock()
+	for key, entry = range e.aggregated {
+		pending[key] = &aggregateEntry{addrs: make(map[string]bool),
+			encoding: entry.encoding}
+		for addr = range entry.addrs {
+			pending[key].addrs[addr] = true
+		}
+	}
+	e.mtx.Unlock()
+
+	for key, entry = range pending {
+		for addr = range entry.addrs {
+			rerr = e.RemoveFromAggregatedKey(ctx, key, entry.encoding, addr)
+			if rerr != nil {
+				err = rerr
+			}
+		}
+	}
+
+	return err
+}
+
+/*
+updateAggregatedKey replaces the list of addresses stored in "key" with the
+result of applying "update" to it. The update is only committed if the key
+was not modified in the meantime; otherwise, it is retried with the new list.
+*/
+func (e *ServiceExporter) updateAggregatedKey(
+	ctx context.Context, key string, enc ListEncoding,
+	update func([]string) []string) error {
+	var resp *etcd.GetResponse
+	var txnResp *etcd.TxnResponse
+	var cmp etcd.Cmp
+	var op etcd.Op
+	var addrs []string
+	var value string
+	var attempt int
+	var err error
+
+	for attempt = 0; attempt < aggregateMaxAttempts; attempt++ {
+		if resp, err = e.kv.Get(ctx, key); err != nil {
+			return err
+		}
+
+		if len(resp.Kvs) == 0 {
+			// Only create the key if nobody else did.
+			addrs = nil
+			cmp = etcd.Compare(etcd.CreateRevision(key), "=", 0)
+		} else {
+			addrs, err = decodeAddressList(resp.Kvs[0].Value, enc)
+			if err != nil {
+				return err
+			}
+			cmp = etcd.Compare(etcd.ModRevision(key), "=",
+				resp.Kvs[0].ModRevision)
+		}
+
+		addrs = update(addrs)
+		if len(addrs) == 0 {
+			op = etcd.OpDelete(key)
+		} else {
+			if value, err = encodeAddressList(addrs, enc); err != nil {
+				return err
+			}
+			op = etcd.OpPut(key, value)
+		}
+
+		txnResp, err = e.kv.Txn(ctx).If(cmp).Then(op).Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+
+	return ErrAggregateConflict
+}
+
+/*
+decodeAddressList decodes the list of addresses "data" stored in an
+aggregated key.
+*/
+func decodeAddressList(data []byte, enc ListEncoding) ([]string, error) {
+	var rv []string
+	var line string
+	var err error
+
+	if enc == JSONList {
+		if len(data) == 0 {
+			return nil, nil
+		}
+		if err = json.Unmarshal(data, &rv); err != nil {
+			return nil, err
+		}
+		return rv, nil
+	}
+
+	for _, line = range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			rv = append(rv, line)
+		}
+	}
+
+	return rv, nil
+}
+
+/*
+encodeAddressList encodes "addrs" for storing them in an aggregated key.
+*/
+func encodeAddressList(addrs []string, enc ListEncoding) (string, error) {
+	var data []byte
+	var err error
+
+	if enc == JSONList {
+		if data, err = json.Marshal(addrs); err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	return strings.Join(addrs, "\n") + "\n", nil
+}
@@ -0,0 +1,144 @@
+package exportedservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// PortSpec describes a port to be opened and exported by ExportPorts.
+type PortSpec struct {
+	// Network is the network to listen on, e.g. "tcp".
+	Network string
+
+	// IP is the address to listen on; see NewExportedPort.
+	IP string
+
+	// Service is the name the port is exported as.
+	Service string
+
+	// Options control how the port is exported.
+	Options []ExportOption
+}
+
+/*
+ExportPorts opens a new port for every entry of "specs" and exports all of
+them through etcd in a single transaction, so either all or none of the ports
+are registered. The listeners are returned in the order of "specs". If any of
+the ports can't be opened or exported, all listeners opened so far are closed.
+
+If several entries share the same service name, their index among the entries
+for that service is appended to the key, as with NewExportedPortMulti.
+*/
+func (e *ServiceExporter) ExportPorts(
+	ctx context.Context, specs []PortSpec) ([]net.Listener, error) {
+	return e.exportPorts(ctx, specs, "")
+}
+
+/*
+ExportGroup works like ExportPorts, but marks all ports as alternative ways
+of reaching the same instance, e.g. a raw TCP port and a WebSocket port, by
+exporting them as JSON encoded Endpoints with their Group set to "group".
+Clients unable to use one of the ports can fall back to the others of the
+same group. As all ports are written in a single transaction, clients never
+see an incomplete group.
+*/
+func (e *ServiceExporter) ExportGroup(ctx context.Context, group string,
+	specs []PortSpec) ([]net.Listener, error) {
+	if group == "" {
+		return nil, errors.New("empty group identifier")
+	}
+
+	return e.exportPorts(ctx, specs, group)
+}
+
+/*
+exportPorts implements ExportPorts and ExportGroup. Unless "group" is empty,
+it is recorded in all exported endpoints.
+*/
+func (e *ServiceExporter) exportPorts(ctx context.Context, specs []PortSpec,
+	group string) ([]net.Listener, error) {
+	var listeners = make([]net.Listener, 0, len(specs))
+	var exports = make([]*export, len(specs))
+	var counts = make(map[string]int)
+	var seen = make(map[string]int)
+	var cfg *exportConfig
+	var spec PortSpec
+	var l net.Listener
+	var i int
+	var err error
+
+	for _, spec = range specs {
+		counts[spec.Service]++
+	}
+
+	for i, spec = range specs {
+		cfg = newExportConfig(spec.Options)
+		if l, err = cfg.listen(ctx, spec.Network, spec.IP); err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+
+		exports[i] = cfg.export(spec.Service, l)
+		if group != "" {
+			exports[i].endpoint.SchemaVersion = EndpointSchemaVersion
+			exports[i].endpoint.Group = group
+		}
+		if counts[spec.Service] > 1 {
+			exports[i].suffix = fmt.Sprintf("-%d", seen[spec.Service])
+			seen[spec.Service]++
+		}
+	}
+
+	if err = e.commitExports(ctx, exports); err != nil {
+		closeListeners(listeners)
+		return nil, err
+	}
+
+	return listeners, nil
+}
+
+/*
+ExportListenerAs exports the existing listener "l" under all of the names in
+"services" in a single transaction, e.g. for a port which has to appear as
+several logical services. All keys share the lease of the exporter, and are
+removed again by UnexportPort.
+*/
+func (e *ServiceExporter) ExportListenerAs(ctx context.Context,
+	services []string, l net.Listener, opts ...ExportOption) error {
+	return e.exportListenerAs(ctx, services, l, nil, newExportConfig(opts))
+}
+
+/*
+exportListenerAs works like ExportListenerAs, but exports "l" as a copy of
+"ep" with the address filled in like newExportedEndpoint, unless it is nil.
+*/
+func (e *ServiceExporter) exportListenerAs(ctx context.Context,
+	services []string, l net.Listener, ep *Endpoint, cfg *exportConfig) error {
+	var exports = make([]*export, len(services))
+	var i int
+
+	for i = range services {
+		exports[i] = cfg.export(services[i], l)
+		if ep != nil {
+			exports[i].endpoint = new(Endpoint)
+			*exports[i].endpoint = *ep
+			cfg.fillEndpoint(exports[i].endpoint, l)
+		}
+	}
+
+	return e.commitExports(ctx, exports)
+}
+
+/*
+closeListeners closes all of "listeners", ignoring errors.
+*/
+func closeListeners(listeners []net.Listener) {
+	var l net.Listener
+
+	for _, l = range listeners {
+		l.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package exportedservice
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errLeasePending is returned by reExport if another lease is being granted
+// at the same time.
+var errLeasePending = errors.New("lease is already being granted")
+
+// bestEffortMaxBackoff is the longest time to wait between attempts at
+// exporting a port in best-effort mode; see WithBestEffort.
+const bestEffortMaxBackoff = 30 * time.Second
+
+/*
+exportInBackground tries to write "exp" to etcd until it succeeds, doubling
+the time between attempts up to bestEffortMaxBackoff. It gives up once "ctx"
+is done, the exporter is closed, or the export is refused for reasons which
+retrying won't fix.
+*/
+func (e *ServiceExporter) exportInBackground(ctx context.Context, exp *export) {
+	var delay = reExportRetryInterval
+	var err error
+
+	defer e.consumers.Done()
+
+	for {
+		if err = e.commitExports(ctx, []*export{exp}); err == nil {
+			return
+		}
+
+		if errors.Is(err, ErrInvalidServiceName) ||
+			errors.Is(err, ErrUnroutableAddress) {
+			e.logf("exportedservice: giving up exporting %s: %s",
+				exp.service, err)
+			return
+		}
+
+		e.logf("exportedservice: exporting %s failed, retrying in %s: %s",
+			exp.service, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.keepaliveCtx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > bestEffortMaxBackoff {
+			delay = bestEffortMaxBackoff
+		}
+	}
+}
+
+/*
+grantInBackground grants the lease of an exporter created with
+WithBackgroundLease whose constructor could not reach etcd, retrying with
+increasing delays until it succeeds or the exporter is closed. Ports which
+were exported in the meantime are not affected, as they can't be exported
+without a lease.
+*/
+func (e *ServiceExporter) grantInBackground() {
+	var delay = reExportRetryInterval
+	var err error
+
+	defer e.consumers.Done()
+
+	for {
+		if err = e.reExport(e.keepaliveCtx); err == nil {
+			return
+		}
+
+		select {
+		case <-e.keepaliveCtx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > bestEffortMaxBackoff {
+			delay = bestEffortMaxBackoff
+		}
+	}
+}
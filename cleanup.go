@@ -0,0 +1,123 @@
+package exportedservice
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+/*
+DeleteByLease removes all exported ports under the key prefix "prefix" (e.g.
+DefaultKeyPrefix) which were exported with the lease "lease", e.g. to clean up
+after a crashed host without waiting for the lease to expire. Returns the
+number of keys deleted.
+*/
+func DeleteByLease(ctx context.Context, client *etcd.Client, prefix string,
+	lease etcd.LeaseID) (int64, error) {
+	var id = fmt.Sprintf("%016x", lease)
+
+	return deleteMatching(ctx, client, prefix, func(kv *mvccpb.KeyValue) bool {
+		var name = path.Base(string(kv.Key))
+
+		return kv.Lease == int64(lease) || name == id ||
+			strings.HasSuffix(name, "-"+id) ||
+			strings.Contains(name, id+"-")
+	})
+}
+
+/*
+DeleteByInstance removes all exported ports under the key prefix "prefix"
+which were exported by the instance "instance" (see WithInstanceName),
+regardless of their lease. Only keys of exactly that instance are deleted, not
+those of instances whose name starts with "instance". Returns the number of
+keys deleted.
+*/
+func DeleteByInstance(ctx context.Context, client *etcd.Client, prefix,
+	instance string) (int64, error) {
+	var pattern = instanceKeyPattern(strings.Replace(instance, "/", "_", -1))
+
+	return deleteMatching(ctx, client, prefix, func(kv *mvccpb.KeyValue) bool {
+		return pattern.MatchString(path.Base(string(kv.Key)))
+	})
+}
+
+/*
+instanceKeyPattern returns a pattern matching the last element of the keys
+written by the instance "name", "<name>-<lease ID>" optionally followed by
+the index of the port. Instances whose name merely starts with "name", like
+"web-2" for "web", are not matched.
+*/
+func instanceKeyPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(
+		"^" + regexp.QuoteMeta(name) + "-[0-9a-f]{16}(-[0-9]+)?$")
+}
+
+/*
+RemoveStaleExports removes all keys of "service" which were exported by an
+earlier run of this instance, e.g. one which crashed, but not by this
+exporter, so that the stale entries don't show up in discovery until their
+lease expires. Instances are recognized by their name, so this requires
+WithInstanceName. Returns the number of keys deleted.
+*/
+func (e *ServiceExporter) RemoveStaleExports(
+	ctx context.Context, service string) (int64, error) {
+	var own = make(map[string]bool)
+	var pattern *regexp.Regexp
+	var name string
+	var key string
+
+	e.mtx.Lock()
+	name = e.instanceName
+	for key = range e.exports {
+		own[key] = true
+	}
+	e.mtx.Unlock()
+
+	if name == "" {
+		return 0, ErrNoInstanceName
+	}
+	pattern = instanceKeyPattern(name)
+
+	return deleteMatching(ctx, e.kv, e.servicePrefix(service),
+		func(kv *mvccpb.KeyValue) bool {
+			return !own[string(kv.Key)] &&
+				pattern.MatchString(path.Base(string(kv.Key)))
+		})
+}
+
+/*
+deleteMatching deletes all keys below "prefix" for which "match" returns
+true, and returns the number of keys deleted.
+*/
+func deleteMatching(ctx context.Context, client etcd.KV, prefix string,
+	match func(*mvccpb.KeyValue) bool) (int64, error) {
+	var resp *etcd.GetResponse
+	var dresp *etcd.DeleteResponse
+	var kv *mvccpb.KeyValue
+	var deleted int64
+	var err error
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	if resp, err = client.Get(ctx, prefix, etcd.WithPrefix()); err != nil {
+		return 0, err
+	}
+
+	for _, kv = range resp.Kvs {
+		if !match(kv) {
+			continue
+		}
+
+		if dresp, err = client.Delete(ctx, string(kv.Key)); err != nil {
+			return deleted, err
+		}
+		deleted += dresp.Deleted
+	}
+
+	return deleted, nil
+}
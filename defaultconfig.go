@@ -0,0 +1,59 @@
+package exportedservice
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"go.etcd.io/etcd/client/pkg/v3/srv"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// ErrNoEtcdConfig is returned by DefaultEtcdConfig if neither of the flags
+// configuring how to reach etcd has been set.
+var ErrNoEtcdConfig = errors.New(
+	"no etcd configured: set --etcd-endpoints or --etcd-discovery-srv")
+
+var (
+	etcdEndpoints = flag.String("etcd-endpoints", "",
+		"Comma separated list of etcd client URLs")
+	etcdDiscoverySRV = flag.String("etcd-discovery-srv", "",
+		"Domain whose DNS SRV records list the etcd client URLs")
+	etcdDiscoverySRVName = flag.String("etcd-discovery-srv-name", "",
+		"Suffix of the DNS SRV records to look up in --etcd-discovery-srv")
+)
+
+/*
+DefaultEtcdConfig returns the etcd client configuration used by
+NewFromDefault, taken from the command line flags. The endpoints are either
+listed in --etcd-endpoints, or discovered through the DNS SRV records
+_etcd-client._tcp and _etcd-client-ssl._tcp of the domain in
+--etcd-discovery-srv, like etcdctl does. If neither is set, ErrNoEtcdConfig
+is returned rather than guessing where etcd runs.
+
+The flags are registered on flag.CommandLine, so flag.Parse has to be called
+before.
+*/
+func DefaultEtcdConfig() (etcd.Config, error) {
+	var clients *srv.SRVClients
+	var err error
+
+	if *etcdEndpoints != "" {
+		return etcd.Config{
+			Endpoints: strings.Split(*etcdEndpoints, ","),
+		}, nil
+	}
+
+	if *etcdDiscoverySRV != "" {
+		clients, err = srv.GetClient("etcd-client", *etcdDiscoverySRV,
+			*etcdDiscoverySRVName)
+		if err != nil {
+			return etcd.Config{}, fmt.Errorf("discovering etcd in %s: %w",
+				*etcdDiscoverySRV, err)
+		}
+		return etcd.Config{Endpoints: clients.Endpoints}, nil
+	}
+
+	return etcd.Config{}, ErrNoEtcdConfig
+}
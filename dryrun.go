@@ -0,0 +1,65 @@
+package exportedservice
+
+import (
+	"context"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// dryRunKV wraps an etcd.KV so that all writes are logged through the
+// exporter instead of being performed. Reads are passed through.
+type dryRunKV struct {
+	etcd.KV
+	e *ServiceExporter
+}
+
+func (kv *dryRunKV) Put(ctx context.Context, key, val string,
+	opts ...etcd.OpOption) (*etcd.PutResponse, error) {
+	kv.e.logf("exportedservice: dry run: put %s = %s", key, val)
+	return &etcd.PutResponse{}, nil
+}
+
+func (kv *dryRunKV) Delete(ctx context.Context, key string,
+	opts ...etcd.OpOption) (*etcd.DeleteResponse, error) {
+	kv.e.logf("exportedservice: dry run: delete %s", key)
+	return &etcd.DeleteResponse{}, nil
+}
+
+func (kv *dryRunKV) Txn(ctx context.Context) etcd.Txn {
+	return &dryRunTxn{e: kv.e}
+}
+
+// dryRunTxn logs the writes of the successful branch of a transaction
+// instead of committing it.
+type dryRunTxn struct {
+	e   *ServiceExporter
+	ops []etcd.Op
+}
+
+func (txn *dryRunTxn) If(cs ...etcd.Cmp) etcd.Txn {
+	return txn
+}
+
+func (txn *dryRunTxn) Then(ops ...etcd.Op) etcd.Txn {
+	txn.ops = append(txn.ops, ops...)
+	return txn
+}
+
+func (txn *dryRunTxn) Else(ops ...etcd.Op) etcd.Txn {
+	return txn
+}
+
+func (txn *dryRunTxn) Commit() (*etcd.TxnResponse, error) {
+	var op etcd.Op
+
+	for _, op = range txn.ops {
+		if op.IsPut() {
+			txn.e.logf("exportedservice: dry run: put %s = %s",
+				op.KeyBytes(), op.ValueBytes())
+		} else if op.IsDelete() {
+			txn.e.logf("exportedservice: dry run: delete %s", op.KeyBytes())
+		}
+	}
+
+	return &etcd.TxnResponse{Succeeded: true}, nil
+}
@@ -0,0 +1,101 @@
+package exportedservice
+
+import (
+	"errors"
+	"fmt"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// ErrKeepaliveLost is delivered through ServiceExporter.Err when etcd stops
+// renewing the lease, e.g. because the lease expired or the connection to etcd
+// was lost. Ports exported through the exporter will disappear from etcd.
+var ErrKeepaliveLost = errors.New("etcd lease keepalive lost")
+
+// ErrNoLease is returned when trying to export ports through an exporter
+// which no longer holds a lease, i.e. after Close or DeregisterAll.
+var ErrNoLease = errors.New("exporter holds no etcd lease")
+
+// ErrPortRangeExhausted is returned when none of the ports in the range given
+// to WithPortRange could be bound.
+var ErrPortRangeExhausted = errors.New("no free port in range")
+
+// ErrUnroutableAddress is returned when exporting a port with a loopback or
+// link-local address while WithRequireRoutableAddress is in effect.
+var ErrUnroutableAddress = errors.New(
+	"exported address is not reachable from other hosts")
+
+// ErrNotExported is returned by ReexportPort if the service to update is not
+// exported as exactly one port, and by UpdateMetadata if it is not exported at
+// all.
+var ErrNotExported = errors.New("service is not exported as a single port")
+
+// ErrNoInstanceName is returned by RemoveStaleExports if the exporter was
+// created without WithInstanceName.
+var ErrNoInstanceName = errors.New("exporter has no instance name")
+
+// ErrInvalidServiceName is returned when exporting a port under a service
+// name which is not valid as part of an etcd key; see WithServiceNamePattern.
+var ErrInvalidServiceName = errors.New("invalid service name")
+
+// ErrAlreadyRegistered is returned when exporting a port with WithExclusive
+// while another instance of the service is already exported.
+var ErrAlreadyRegistered = errors.New("service is already registered")
+
+// ErrExclusiveKeyFunc is returned when exporting a port with WithExclusive
+// through an exporter using WithKeyFunc, as other instances of the service
+// can't be recognized by their keys then.
+var ErrExclusiveKeyFunc = errors.New(
+	"exclusive exports require the default key layout")
+
+// ErrLeaseGrantFailed is the kind of LeaseError returned when etcd refuses
+// to grant a lease.
+var ErrLeaseGrantFailed = errors.New("etcd lease grant failed")
+
+// ErrLeaseKeepaliveFailed is the kind of LeaseError returned when renewal of
+// a freshly granted lease can't be started, e.g. because etcd no longer knows
+// about the lease.
+var ErrLeaseKeepaliveFailed = errors.New("etcd lease keepalive failed")
+
+/*
+LeaseError describes a failure to set up an etcd lease. It matches its Kind,
+e.g. ErrLeaseKeepaliveFailed, when using errors.Is, and unwraps to the
+underlying error reported by etcd, to distinguish lease problems from other
+failures such as connection problems.
+*/
+type LeaseError struct {
+	// Kind is the kind of failure, ErrLeaseGrantFailed or
+	// ErrLeaseKeepaliveFailed.
+	Kind error
+
+	// ID is the ID of the affected lease, or NoLease if no lease was
+	// granted.
+	ID etcd.LeaseID
+
+	// Err is the error reported by etcd.
+	Err error
+}
+
+/*
+Error returns a description of the failure, including the underlying error.
+*/
+func (e *LeaseError) Error() string {
+	if e.ID != etcd.NoLease {
+		return fmt.Sprintf("%s (lease %016x): %s", e.Kind, e.ID, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+/*
+Is returns true if "target" is the kind of the failure.
+*/
+func (e *LeaseError) Is(target error) bool {
+	return target == e.Kind
+}
+
+/*
+Unwrap returns the underlying error reported by etcd.
+*/
+func (e *LeaseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,97 @@
+package exportedservice
+
+import (
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// defaultEventBuffer is the number of events buffered for Events unless
+// configured otherwise through WithEventBuffer.
+const defaultEventBuffer = 64
+
+// EventType is the kind of a lifecycle event delivered through Events.
+type EventType int
+
+const (
+	// EventRegistered is emitted when a port has been written to etcd.
+	EventRegistered EventType = iota
+
+	// EventUnregistered is emitted when a port has been removed from etcd.
+	EventUnregistered
+
+	// EventLeaseRenewed is emitted whenever the lease has been renewed.
+	EventLeaseRenewed
+
+	// EventLeaseLost is emitted once the lease can no longer be renewed.
+	EventLeaseLost
+
+	// EventReExported is emitted once all ports have been exported again
+	// with a new lease; see WithAutoReExport.
+	EventReExported
+)
+
+/*
+String returns the name of the event type.
+*/
+func (t EventType) String() string {
+	switch t {
+	case EventRegistered:
+		return "Registered"
+	case EventUnregistered:
+		return "Unregistered"
+	case EventLeaseRenewed:
+		return "LeaseRenewed"
+	case EventLeaseLost:
+		return "LeaseLost"
+	case EventReExported:
+		return "ReExported"
+	}
+
+	return "Unknown"
+}
+
+// Event describes something which happened to the registrations of an
+// exporter.
+type Event struct {
+	// Type is the kind of event.
+	Type EventType
+
+	// Time is the time the event happened.
+	Time time.Time
+
+	// LeaseID is the lease affected by the event.
+	LeaseID etcd.LeaseID
+
+	// Service and Key identify the affected port for EventRegistered
+	// and EventUnregistered.
+	Service string
+	Key     string
+}
+
+/*
+Events returns a channel on which lifecycle events of the exporter are
+delivered as they happen, e.g. for forwarding them to an event bus. By
+default, events are dropped if the channel is full; see WithEventBuffer.
+*/
+func (e *ServiceExporter) Events() <-chan Event {
+	return e.events
+}
+
+/*
+emit delivers the event "ev" through the events channel, dropping it if the
+channel is full unless blocking is configured.
+*/
+func (e *ServiceExporter) emit(ev Event) {
+	ev.Time = time.Now()
+
+	if e.blockOnEvents {
+		e.events <- ev
+		return
+	}
+
+	select {
+	case e.events <- ev:
+	default:
+	}
+}
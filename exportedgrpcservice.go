@@ -0,0 +1,26 @@
+package exportedservice
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+)
+
+/*
+ListenAndServeNamedGRPC makes the gRPC server "server" listen on "addr" and
+exports it as "servicename" using the same key layout as NewExportedPort.
+Returns the error returned by server.Serve.
+*/
+func (e *ServiceExporter) ListenAndServeNamedGRPC(
+	ctx context.Context, servicename, addr string, server *grpc.Server) error {
+	var l net.Listener
+	var err error
+
+	l, err = e.NewExportedPort(ctx, "tcp", addr, servicename)
+	if err != nil {
+		return err
+	}
+
+	return server.Serve(l)
+}
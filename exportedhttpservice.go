@@ -1,26 +1,277 @@
 package exportedservice
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"net/http"
-
-	"golang.org/x/net/context"
+	"time"
 )
 
+// httpUnexportTimeout bounds how long a server waits for its port to be
+// removed from etcd before it stops, so that it still stops while etcd
+// can't be reached.
+const httpUnexportTimeout = 5 * time.Second
+
+// httpShutdownTimeout bounds how long ServeNamed waits for in-flight requests
+// once its context is cancelled, before remaining connections are closed.
+const httpShutdownTimeout = 30 * time.Second
+
 /*
-ListenAndServeNamedHTTP makes the default HTTP server listen on "addr" and
-exports the given "handler". Registers as "servicename".
+ListenAndServeNamedHTTP makes a new HTTP server listen on "addr" and
+exports the given "handler". Registers as "servicename". The address is
+exported as "http://host:port". The options "opts" control how the port is
+exported; see WithReadinessGate for delaying the export until the handler is
+ready, and WithBoundPort for learning the port chosen for an "addr" of ":0".
+
+Once "ctx" is cancelled, the port is unexported, the server is closed and
+ctx.Err() is returned.
 */
 func (e *ServiceExporter) ListenAndServeNamedHTTP(
-	ctx context.Context, servicename, addr string, handler http.Handler) error {
+	ctx context.Context, servicename, addr string, handler http.Handler,
+	opts ...ExportOption) error {
+	var srv = &http.Server{Handler: handler}
 	var l net.Listener
 	var err error
 
 	// We can just create a new port as above...
-	l, err = e.NewExportedPort(ctx, "tcp", addr, servicename)
+	l, err = e.newGatedPort(ctx, addr, []string{servicename}, srv, nil,
+		withDefaultScheme("http", opts))
+	if err != nil {
+		return err
+	}
+
+	return e.serveHTTP(ctx, []string{servicename}, srv, l, false)
+}
+
+/*
+ListenAndServeNamedHTTPAs works like ListenAndServeNamedHTTP, but exports the
+port under all of the names in "servicenames", e.g. for a gateway which has to
+appear as both "api" and "api-v2". All keys share the lease of the exporter,
+and are written in a single transaction.
+*/
+func (e *ServiceExporter) ListenAndServeNamedHTTPAs(
+	ctx context.Context, servicenames []string, addr string,
+	handler http.Handler, opts ...ExportOption) error {
+	var srv = &http.Server{Handler: handler}
+	var l net.Listener
+	var err error
+
+	l, err = e.newGatedPort(ctx, addr, servicenames, srv, nil,
+		withDefaultScheme("http", opts))
+	if err != nil {
+		return err
+	}
+
+	return e.serveHTTP(ctx, servicenames, srv, l, false)
+}
+
+/*
+ListenAndServeNamedHTTPS makes the default HTTP server listen on "addr" using
+the TLS configuration "config" and exports the given "handler". Registers as
+"servicename". The address is exported as "https://host:port" so clients know
+to connect using TLS, with the same metadata as NewExportedTLSPort writes.
+The options "opts" and cancelling "ctx" work like for ListenAndServeNamedHTTP.
+*/
+func (e *ServiceExporter) ListenAndServeNamedHTTPS(
+	ctx context.Context, servicename, addr string, handler http.Handler,
+	config *tls.Config, opts ...ExportOption) error {
+	var srv = &http.Server{Handler: handler}
+	var l net.Listener
+	var err error
+
+	l, err = e.newGatedPort(ctx, addr, []string{servicename}, srv,
+		&Endpoint{Meta: tlsMetadata(config)},
+		withDefaultScheme("https", opts))
+	if err != nil {
+		return err
+	}
+
+	return e.serveHTTP(ctx, []string{servicename}, srv,
+		tls.NewListener(l, config), false)
+}
+
+/*
+withDefaultScheme returns "opts" preceded by WithScheme("scheme"), so that
+the scheme can still be overridden through "opts".
+*/
+func withDefaultScheme(scheme string, opts []ExportOption) []ExportOption {
+	return append([]ExportOption{WithScheme(scheme)}, opts...)
+}
+
+/*
+newGatedPort opens a new TCP port on "addr" for the HTTP server "srv" and
+exports it under all of "servicenames", as "ep" like newExportedEndpoint
+unless it is nil. If a readiness gate is configured, the port is only
+exported once the gate opens, and the server is closed if exporting fails at
+that point.
+*/
+func (e *ServiceExporter) newGatedPort(ctx context.Context, addr string,
+	servicenames []string, srv *http.Server, ep *Endpoint,
+	opts []ExportOption) (net.Listener, error) {
+	var cfg = newExportConfig(opts)
+	var l net.Listener
+	var err error
+
+	if l, err = cfg.listen(ctx, "tcp", addr); err != nil {
+		return nil, err
+	}
+	e.logBoundPort(servicenames, l)
+
+	if cfg.ready == nil {
+		err = e.exportListenerAs(ctx, servicenames, l, ep, cfg)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	go func() {
+		var err error
+
+		select {
+		case <-cfg.ready:
+		case <-ctx.Done():
+			return
+		}
+
+		err = e.exportListenerAs(ctx, servicenames, l, ep, cfg)
+		if err != nil {
+			e.logf("exportedservice: exporting %v once ready: %s",
+				servicenames, err)
+			srv.Close()
+		}
+	}()
+
+	return l, nil
+}
+
+/*
+ServeNamed exports a new port on "addr" as "servicename" and runs the
+preconfigured HTTP server "srv" on it, so that settings like ReadTimeout,
+WriteTimeout and IdleTimeout are honored. The Addr field of "srv" is ignored.
+
+Once "ctx" is cancelled, the port is unexported and the server is shut down
+gracefully, waiting up to 30 seconds for in-flight requests to finish, before
+ctx.Err() is returned. Connections still open by then are closed.
+*/
+func (e *ServiceExporter) ServeNamed(
+	ctx context.Context, servicename, addr string, srv *http.Server) error {
+	var l net.Listener
+	var err error
+
+	l, err = e.NewExportedPort(ctx, "tcp", addr, servicename,
+		WithScheme("http"))
 	if err != nil {
 		return err
 	}
 
-	return http.Serve(l, handler)
+	return e.serveHTTP(ctx, []string{servicename}, srv, l, true)
+}
+
+/*
+serveHTTP runs "srv" on the exported listener "l" until either serving fails
+or "ctx" is cancelled. In the latter case, "servicenames" are unexported
+before the server is closed, or shut down gracefully if "graceful" is set, and
+ctx.Err() is returned. The server is stopped even if unexporting fails.
+*/
+func (e *ServiceExporter) serveHTTP(ctx context.Context,
+	servicenames []string, srv *http.Server, l net.Listener,
+	graceful bool) error {
+	var serveDone = make(chan struct{})
+	var stopped = make(chan struct{})
+	var err error
+
+	go func() {
+		var unexportCtx, shutdownCtx context.Context
+		var cancel context.CancelFunc
+		var err error
+
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			unexportCtx, cancel = context.WithTimeout(context.Background(),
+				httpUnexportTimeout)
+			for _, name := range servicenames {
+				_, err = e.UnexportPortByName(unexportCtx, name)
+				if err != nil {
+					e.logf("exportedservice: unexporting %s: %s", name, err)
+				}
+			}
+			cancel()
+			if graceful {
+				shutdownCtx, cancel = context.WithTimeout(
+					context.Background(), httpShutdownTimeout)
+				if srv.Shutdown(shutdownCtx) != nil {
+					// Some clients didn't finish in time.
+					srv.Close()
+				}
+				cancel()
+			} else {
+				srv.Close()
+			}
+		case <-serveDone:
+		}
+	}()
+
+	err = srv.Serve(l)
+	close(serveDone)
+	<-stopped
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+/*
+StartNamedHTTP makes a new HTTP server listen on "addr" and exports the given
+"handler" as "servicename", like ListenAndServeNamedHTTP. The server is run in
+the background.
+
+The returned function shuts the server down gracefully: it first removes the
+port from etcd so clients stop sending new requests, then waits for in-flight
+requests to finish, or for its context to expire. The server is shut down
+even if the port couldn't be removed from etcd. It returns the errors of
+unexporting and shutting down, as well as any error the server encountered
+while serving.
+*/
+func (e *ServiceExporter) StartNamedHTTP(
+	ctx context.Context, servicename, addr string, handler http.Handler) (
+	func(context.Context) error, error) {
+	var srv = &http.Server{Handler: handler}
+	var serveErr = make(chan error, 1)
+	var l net.Listener
+	var err error
+
+	l, err = e.NewExportedPort(ctx, "tcp", addr, servicename,
+		WithScheme("http"))
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+
+	return func(ctx context.Context) error {
+		var unexportErr, err error
+
+		// Stop routing clients to us before we stop serving.
+		_, unexportErr = e.UnexportPortByName(ctx, servicename)
+
+		if err = srv.Shutdown(ctx); err != nil {
+			return errors.Join(unexportErr, err)
+		}
+
+		if err = <-serveErr; err != http.ErrServerClosed {
+			return errors.Join(unexportErr, err)
+		}
+
+		return unexportErr
+	}, nil
 }
@@ -8,27 +8,427 @@ There are convenience methods for exporting a TLS port and an HTTP service.
 package exportedservice
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
-	"github.com/caoimhechaos/go-etcd-clientbuilder/autoconf"
-	etcd "github.com/coreos/etcd/clientv3"
-	"golang.org/x/net/context"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
+// MinTTL is the minimum lease TTL, in seconds, accepted by the constructors.
+const MinTTL = 5
+
+// keepaliveRestartAttempts is the number of attempts made at resuming the
+// renewal of a lease after the keepalive channel was closed, and
+// keepaliveRestartDelay the time to wait before each attempt.
+const (
+	keepaliveRestartAttempts = 3
+	keepaliveRestartDelay    = 500 * time.Millisecond
+)
+
+// reExportRetryInterval is the time to wait between attempts at re-exporting
+// ports after the lease has been lost.
+const reExportRetryInterval = time.Second
+
+// export describes a port exported through a ServiceExporter.
+type export struct {
+	service  string
+	suffix   string // appended to the key, if not unique by itself
+	endpoint *Endpoint
+	value    string // endpoint as encoded for etcd
+
+	// exclusive ports are only exported if no other instance of the
+	// service is; see WithExclusive.
+	exclusive bool
+
+	// shadowPrefix requests an additional registration of the port under
+	// the given prefix; see WithShadowPrefix. The resulting export has
+	// prefix set, and shadowOf pointing to the original export.
+	shadowPrefix string
+	prefix       string
+	shadowOf     *export
+
+	// lease is the lease of its own the port is exported with, or NoLease
+	// if it uses the lease of the exporter. cancel stops its renewal.
+	lease  etcd.LeaseID
+	cancel context.CancelFunc
+}
+
 // ServiceExporter exists because we need to initialize our etcd client
 // beforehand and keep it somewhere.
 type ServiceExporter struct {
 	conn               *etcd.Client
-	path               string
+	kv                 etcd.KV
+	lease              etcd.Lease
+	watcher            etcd.Watcher
+	exports            map[string]*export // keyed by etcd key
+	exportsChanged     chan struct{}      // closed when exports are added
+	aggregated         map[string]*aggregateEntry
 	leaseID            etcd.LeaseID
+	ttl                int64 // requested
+	grantedTTL         int64
+	reportedTTL        int64 // by the last keepalive response
 	keepaliveResponses <-chan *etcd.LeaseKeepAliveResponse
+	keepaliveCtx       context.Context
+	cancelKeepalive    context.CancelFunc
+	lastKeepalive      time.Time
+	renewals           int64
+	missedRenewals     int64
+	renewing           bool
+	grantingLease      bool // by reExport
+	session            *concurrency.Session
+	borrowedLease      bool             // lease is owned and renewed elsewhere
+	primary            *ServiceExporter // whose lease is shared
+
+	errors                    chan error
+	metrics                   Metrics
+	logger                    atomic.Value // of loggerHolder
+	keyPrefix                 string
+	instanceName              string
+	keyFunc                   KeyFunc
+	encoder                   EndpointEncoder
+	requireRoutable           bool
+	serviceNamePattern        *regexp.Regexp
+	events                    chan Event
+	blockOnEvents             bool
+	autoReExport              bool
+	contextBoundRenewal       bool
+	noKeepalive               bool
+	backgroundLease           bool
+	keepaliveJitter           float64
+	keepaliveFailureThreshold int
+	initAttempts              int
+	initBackoff               time.Duration
+	writeAttempts             int
+	writeBackoff              time.Duration
+	refreshInterval           time.Duration
+	endpointSyncInterval      time.Duration
+
+	mtx    sync.Mutex
+	closed bool
+
+	// consumers tracks the background goroutines of the exporter.
+	consumers sync.WaitGroup
+}
+
+/*
+newServiceExporter creates a new exporter object around the etcd client
+"client" and applies the options "opts" to it. The lease is not initialized.
+*/
+func newServiceExporter(client *etcd.Client, opts []Option) *ServiceExporter {
+	var rv = &ServiceExporter{
+		conn:      client,
+		kv:        client.KV,
+		lease:     client.Lease,
+		watcher:   client.Watcher,
+		metrics:   nopMetrics{},
+		errors:    make(chan error, 1),
+		events:    make(chan Event, defaultEventBuffer),
+		keyPrefix: DefaultKeyPrefix,
+	}
+	var opt Option
+
+	for _, opt = range opts {
+		opt(rv)
+	}
+
+	return rv
+}
+
+/*
+consumeKeepaliveResponses drains the keepalive responses from "ch", which
+renews the lease until "ctx" is cancelled. If etcd closes the channel, e.g.
+due to a transient stream error, renewal of the lease is restarted while the
+lease is still valid. Once that fails, the lease is no longer being renewed,
+which is reported through the error channel. If the channel was closed
+because "ctx" was cancelled, e.g. by Close, renewal was stopped on purpose,
+and the consumer exits quietly.
+*/
+func (e *ServiceExporter) consumeKeepaliveResponses(ctx context.Context,
+	ch <-chan *etcd.LeaseKeepAliveResponse) {
+	var resp *etcd.LeaseKeepAliveResponse
+	var now time.Time
+	var err error
+
+	defer e.consumers.Done()
+
+	for ch != nil {
+		for resp = range ch {
+			now = time.Now()
+
+			e.mtx.Lock()
+			e.metrics.LeaseRenewed(now.Sub(e.lastKeepalive))
+			e.lastKeepalive = now
+			e.reportedTTL = resp.TTL
+			e.renewals++
+			e.mtx.Unlock()
+
+			e.emit(Event{Type: EventLeaseRenewed, LeaseID: resp.ID})
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+		e.missedRenewal()
+		ch = e.restartKeepalive(ctx)
+	}
+
+	e.mtx.Lock()
+	e.renewing = false
+	if ctx.Err() != nil {
+		e.mtx.Unlock()
+		return
+	}
+	e.logf("exportedservice: keepalive for lease %016x lost", e.leaseID)
+	e.emit(Event{Type: EventLeaseLost, LeaseID: e.leaseID})
+	e.mtx.Unlock()
+
+	e.metrics.KeepaliveFailed()
+
+	// Don't block if nobody is listening or the error is already pending.
+	select {
+	case e.errors <- ErrKeepaliveLost:
+	default:
+	}
+
+	if !e.autoReExport {
+		return
+	}
+
+	for {
+		e.mtx.Lock()
+		if e.closed || ctx.Err() != nil {
+			e.mtx.Unlock()
+			return
+		}
+		e.mtx.Unlock()
+
+		// The member we were talking to may be gone for good.
+		if e.endpointSyncInterval > 0 && e.conn != nil {
+			e.conn.Sync(ctx)
+		}
+
+		if err = e.reExport(ctx); err == nil {
+			return
+		}
+
+		time.Sleep(reExportRetryInterval)
+	}
+}
+
+/*
+syncEndpoints updates the list of etcd endpoints of the client with the
+current members of the cluster every endpointSyncInterval, until "ctx" is
+done.
+*/
+func (e *ServiceExporter) syncEndpoints(ctx context.Context) {
+	var ticker = time.NewTicker(e.endpointSyncInterval)
+	var err error
+
+	defer e.consumers.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err = e.conn.Sync(ctx); err != nil {
+			e.logf("exportedservice: syncing etcd endpoints: %s", err)
+		}
+	}
+}
+
+/*
+restartKeepalive tries to resume renewal of the current lease until "ctx" is
+cancelled, after the keepalive channel was closed. It makes up to
+keepaliveRestartAttempts attempts, or as many as configured through
+WithKeepaliveFailureThreshold, as long as etcd still reports the lease as
+alive. Returns the new keepalive channel, or nil if renewal could not be
+resumed.
+*/
+func (e *ServiceExporter) restartKeepalive(
+	ctx context.Context) <-chan *etcd.LeaseKeepAliveResponse {
+	var ttl *etcd.LeaseTimeToLiveResponse
+	var ch <-chan *etcd.LeaseKeepAliveResponse
+	var attempts = keepaliveRestartAttempts
+	var leaseID etcd.LeaseID
+	var attempt int
+	var err error
+
+	if e.keepaliveFailureThreshold > 0 {
+		attempts = e.keepaliveFailureThreshold
+	}
+
+	for attempt = 0; attempt < attempts; attempt++ {
+		e.mtx.Lock()
+		if e.closed || ctx.Err() != nil {
+			e.mtx.Unlock()
+			return nil
+		}
+		leaseID = e.leaseID
+		e.mtx.Unlock()
+
+		time.Sleep(keepaliveRestartDelay)
+
+		// There's no point in renewing a lease which is already gone.
+		ttl, err = e.lease.TimeToLive(ctx, leaseID)
+		if err == nil && ttl.TTL <= 0 {
+			return nil
+		}
+		if err != nil {
+			e.missedRenewal()
+			continue
+		}
+
+		ch, err = e.keepAlive(ctx, leaseID, ttl.GrantedTTL)
+		if err != nil {
+			e.missedRenewal()
+		} else {
+			e.mtx.Lock()
+			e.keepaliveResponses = ch
+			e.mtx.Unlock()
+
+			e.logf("exportedservice: restarted keepalive for lease %016x",
+				leaseID)
+			return ch
+		}
+	}
+
+	return nil
 }
 
-func consumeKeepaliveResponses(ch <-chan *etcd.LeaseKeepAliveResponse) {
-	for _ = range ch {
+/*
+reExport grants a new lease and writes all previously exported ports to etcd
+again using the new lease. Renewal of the new lease is only started once all
+ports have been exported successfully. The lock is not held while talking to
+etcd, so that Close and the accessors don't block while etcd is unreachable;
+until the ports have been exported again, the exporter holds no lease.
+*/
+func (e *ServiceExporter) reExport(ctx context.Context) error {
+	var lease *etcd.LeaseGrantResponse
+	var ch <-chan *etcd.LeaseKeepAliveResponse
+	var pending = make(map[string]*export) // keyed by old key
+	var values = make(map[string]string)   // keyed by old key
+	var exports = make(map[string]*export)
+	var removed []string
+	var exp *export
+	var path string
+	var ttl int64
+	var err error
+
+	e.mtx.Lock()
+	if e.closed {
+		e.mtx.Unlock()
+		return ErrNoLease
+	}
+	if e.grantingLease {
+		e.mtx.Unlock()
+		return errLeasePending
+	}
+	e.grantingLease = true
+	defer func() {
+		e.mtx.Lock()
+		e.grantingLease = false
+		e.mtx.Unlock()
+	}()
+	// No ports can be exported with the lost lease in the meantime.
+	e.leaseID = etcd.NoLease
+	ttl = e.ttl
+	for path, exp = range e.exports {
+		// Ports with a lease of their own are not affected.
+		if exp.lease == etcd.NoLease {
+			pending[path] = exp
+			values[path] = exp.value
+		}
+	}
+	e.mtx.Unlock()
+
+	if lease, err = e.lease.Grant(ctx, ttl); err != nil {
+		return &LeaseError{Kind: ErrLeaseGrantFailed, Err: err}
+	}
+
+	for path, exp = range pending {
+		_, err = e.kv.Put(ctx, e.leasePath(exp, lease.ID), values[path],
+			etcd.WithLease(lease.ID))
+		if err != nil {
+			e.lease.Revoke(ctx, lease.ID)
+			return err
+		}
 	}
+
+	// Without keepalive, the lease is left to expire like the first one.
+	if !e.noKeepalive {
+		ch, err = e.keepAlive(e.keepaliveCtx, lease.ID, lease.TTL)
+		if err != nil {
+			e.lease.Revoke(ctx, lease.ID)
+			return &LeaseError{Kind: ErrLeaseKeepaliveFailed, ID: lease.ID,
+				Err: err}
+		}
+	}
+
+	e.mtx.Lock()
+	if e.closed {
+		e.mtx.Unlock()
+		e.lease.Revoke(context.Background(), lease.ID)
+		return ErrNoLease
+	}
+
+	e.leaseID = lease.ID
+	e.setGrantedTTL(lease.TTL)
+
+	for path, exp = range e.exports {
+		if exp.lease != etcd.NoLease {
+			exports[path] = exp
+		}
+	}
+	for path, exp = range pending {
+		if e.exports[path] != exp {
+			// Unexported while we were writing it.
+			removed = append(removed, e.exportPath(exp))
+			continue
+		}
+		exports[e.exportPath(exp)] = exp
+	}
+
+	e.exports = exports
+	e.notifyExports()
+	e.keepaliveResponses = ch
+	e.lastKeepalive = time.Now()
+	e.reportedTTL = 0 // not renewed yet
+	e.renewing = !e.noKeepalive
+
+	e.logf("exportedservice: re-exported %d ports with lease %016x",
+		len(exports), e.leaseID)
+	e.emit(Event{Type: EventReExported, LeaseID: e.leaseID})
+
+	if !e.noKeepalive {
+		e.consumers.Add(1)
+		go e.consumeKeepaliveResponses(e.keepaliveCtx, ch)
+	}
+	e.mtx.Unlock()
+
+	for _, path = range removed {
+		e.kv.Delete(ctx, path)
+	}
+
+	return nil
 }
 
 /*
@@ -39,8 +439,8 @@ port will stop being exported.
 The specified ttl (which must be at least 5 (seconds)) determines how frequently
 the lease will be renewed.
 */
-func NewExporter(ctx context.Context, etcdURL string, ttl int64) (
-	*ServiceExporter, error) {
+func NewExporter(ctx context.Context, etcdURL string, ttl int64,
+	opts ...Option) (*ServiceExporter, error) {
 	var self *ServiceExporter
 	var client *etcd.Client
 	var err error
@@ -50,38 +450,115 @@ func NewExporter(ctx context.Context, etcdURL string, ttl int64) (
 		return nil, err
 	}
 
-	self = &ServiceExporter{
-		conn: client,
+	self = newServiceExporter(client, opts)
+
+	return self, self.initLease(ctx, ttl)
+}
+
+/*
+NewExporterWithEndpoints works like NewExporter, but connects to any of the
+etcd cluster members in "endpoints", so that the exporter keeps working if
+some of them are unavailable: the etcd client fails over to the remaining
+members. See WithEndpointSync for keeping the list of members current.
+*/
+func NewExporterWithEndpoints(ctx context.Context, endpoints []string,
+	ttl int64, opts ...Option) (*ServiceExporter, error) {
+	var self *ServiceExporter
+	var client *etcd.Client
+	var err error
+
+	client, err = etcd.NewFromURLs(endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	self = newServiceExporter(client, opts)
+
+	return self, self.initLease(ctx, ttl)
+}
+
+/*
+NewExporterWithTLS works like NewExporter, but connects to etcd using the TLS
+configuration "tlsConfig", which can carry the CA and client certificates
+required by a TLS secured etcd cluster.
+*/
+func NewExporterWithTLS(ctx context.Context, etcdURL string,
+	tlsConfig *tls.Config, ttl int64, opts ...Option) (
+	*ServiceExporter, error) {
+	return NewExporterFromConfig(ctx, etcd.Config{
+		Endpoints: []string{etcdURL},
+		TLS:       tlsConfig,
+	}, ttl, opts...)
+}
+
+/*
+NewExporterWithAuth works like NewExporter, but authenticates to etcd as
+"username" with "password", as required by etcd clusters with authentication
+enabled. The credentials apply to all operations of the exporter, including
+lease management.
+*/
+func NewExporterWithAuth(ctx context.Context, etcdURL, username,
+	password string, ttl int64, opts ...Option) (*ServiceExporter, error) {
+	return NewExporterFromConfig(ctx, etcd.Config{
+		Endpoints: []string{etcdURL},
+		Username:  username,
+		Password:  password,
+	}, ttl, opts...)
+}
+
+/*
+NewExporterFromConfig works like NewExporter, but creates the etcd client
+from the client configuration "config". This gives full control over the
+connection to etcd, e.g. DialTimeout, DialKeepAliveTime, AutoSyncInterval or
+additional gRPC dial options, which may need tuning for a distant etcd
+cluster.
+*/
+func NewExporterFromConfig(ctx context.Context, config etcd.Config,
+	ttl int64, opts ...Option) (*ServiceExporter, error) {
+	var self *ServiceExporter
+	var client *etcd.Client
+	var err error
+
+	if client, err = etcd.New(config); err != nil {
+		return nil, err
 	}
 
+	self = newServiceExporter(client, opts)
+
 	return self, self.initLease(ctx, ttl)
 }
 
 /*
 NewFromDefault creates a new exporter object which can later be used to create
 exported ports and services. This will create a client connection to etcd using
-the flags based DNS autoconfiguration.
+the configuration from the command line flags; see DefaultEtcdConfig.
 
 If the connection is severed, once the etcd lease is going to expire the
 port will stop being exported.
 
 The specified ttl (which must be at least 5 (seconds)) determines how frequently
 the lease will be renewed.
+
+Errors setting up the lease, including "ctx" expiring in the process, are
+returned as a LeaseError, to tell them apart from failures to create the etcd
+client.
 */
-func NewFromDefault(ctx context.Context, ttl int64) (*ServiceExporter, error) {
+func NewFromDefault(ctx context.Context, ttl int64, opts ...Option) (
+	*ServiceExporter, error) {
 	var self *ServiceExporter
+	var config etcd.Config
 	var client *etcd.Client
 	var err error
 
-	client, err = autoconf.DefaultEtcdClient()
-	if err != nil {
+	if config, err = DefaultEtcdConfig(); err != nil {
 		return nil, err
 	}
-
-	self = &ServiceExporter{
-		conn: client,
+	if client, err = etcd.New(config); err != nil {
+		return nil, fmt.Errorf("creating etcd client: %w", err)
 	}
 
+	self = newServiceExporter(client, opts)
+
 	return self, self.initLease(ctx, ttl)
 }
 
@@ -90,115 +567,1528 @@ NewExporterFromClient creates a new exporter by reading etcd flags from the
 specified configuration file.
 */
 func NewExporterFromClient(
-	ctx context.Context, client *etcd.Client, ttl int64) (
+	ctx context.Context, client *etcd.Client, ttl int64, opts ...Option) (
 	*ServiceExporter, error) {
-	var rv = &ServiceExporter{
-		conn: client,
-	}
+	var rv = newServiceExporter(client, opts)
 
 	return rv, rv.initLease(ctx, ttl)
 }
 
+/*
+NewExporterFromSession creates a new exporter which exports ports using the
+lease of the etcd concurrency session "s", e.g. one also used for leader
+election, so that the election and the registration expire together. The
+lease is renewed by the session; the exporter merely watches for the session
+to end, which is reported through Err like a lost keepalive. Automatic
+re-exporting (see WithAutoReExport) does not apply.
+
+Close and DeregisterAll remove the exported keys, but leave the lease and the
+etcd client of the session alone.
+*/
+func NewExporterFromSession(
+	ctx context.Context, s *concurrency.Session, opts ...Option) (
+	*ServiceExporter, error) {
+	var rv = newServiceExporter(s.Client(), opts)
+
+	return rv, rv.initSessionLease(ctx, s)
+}
+
+/*
+initSessionLease makes the exporter use the lease of the session "s" and
+starts watching the session.
+*/
+func (e *ServiceExporter) initSessionLease(
+	ctx context.Context, s *concurrency.Session) error {
+	var resp *etcd.LeaseTimeToLiveResponse
+	var err error
+
+	if resp, err = e.lease.TimeToLive(ctx, s.Lease()); err != nil {
+		return &LeaseError{Kind: ErrLeaseGrantFailed, ID: s.Lease(), Err: err}
+	}
+
+	e.keepaliveCtx, e.cancelKeepalive = context.WithCancel(
+		context.Background())
+	e.session = s
+	e.borrowedLease = true
+	e.leaseID = s.Lease()
+	e.ttl = resp.GrantedTTL
+	e.grantedTTL = resp.GrantedTTL
+	e.lastKeepalive = time.Now()
+	e.renewing = true
+
+	e.logf("exportedservice: using session lease %016x with ttl %d",
+		e.leaseID, e.ttl)
+
+	e.consumers.Add(1)
+	go e.watchSession(s)
+
+	if e.refreshInterval > 0 {
+		e.consumers.Add(1)
+		go e.refreshExports(e.keepaliveCtx)
+	}
+
+	if e.endpointSyncInterval > 0 && e.conn != nil {
+		e.consumers.Add(1)
+		go e.syncEndpoints(e.keepaliveCtx)
+	}
+
+	return nil
+}
+
+/*
+watchSession waits for the session "s" to end, which is reported through the
+error channel, unless the exporter is closed first.
+*/
+func (e *ServiceExporter) watchSession(s *concurrency.Session) {
+	defer e.consumers.Done()
+
+	select {
+	case <-e.keepaliveCtx.Done():
+		return
+	case <-s.Done():
+	}
+
+	e.mtx.Lock()
+	e.renewing = false
+	e.mtx.Unlock()
+
+	e.logf("exportedservice: session for lease %016x ended", s.Lease())
+	e.emit(Event{Type: EventLeaseLost, LeaseID: s.Lease()})
+	e.metrics.KeepaliveFailed()
+
+	select {
+	case e.errors <- ErrKeepaliveLost:
+	default:
+	}
+}
+
+/*
+checkTTL returns an error if "ttl" is too short to be renewed reliably.
+*/
+func checkTTL(ttl int64) error {
+	if ttl < MinTTL {
+		return fmt.Errorf("ttl must be at least %d seconds, got %d", MinTTL, ttl)
+	}
+
+	return nil
+}
+
 /*
 initLease initializes the lease on the etcd service which will be used to export
 ports in the future.
 */
 func (e *ServiceExporter) initLease(ctx context.Context, ttl int64) error {
 	var lease *etcd.LeaseGrantResponse
+	var delay = e.initBackoff
+	var attempt int
 	var err error
 
-	lease, err = e.conn.Grant(ctx, ttl)
-	if err != nil {
+	if err = checkTTL(ttl); err != nil {
 		return err
 	}
 
-	e.keepaliveResponses, err = e.conn.KeepAlive(context.Background(), lease.ID)
-	if err != nil {
-		return err
+	// Renewal is bound to a context of our own so that Close can stop it.
+	if e.contextBoundRenewal {
+		e.keepaliveCtx, e.cancelKeepalive = context.WithCancel(ctx)
+	} else {
+		e.keepaliveCtx, e.cancelKeepalive = context.WithCancel(
+			context.Background())
+	}
+
+	for attempt = 1; ; attempt++ {
+		lease, err = e.lease.Grant(ctx, ttl)
+		if err == nil && e.noKeepalive {
+			break
+		} else if err == nil {
+			e.keepaliveResponses, err = e.keepAlive(
+				e.keepaliveCtx, lease.ID, lease.TTL)
+			if err == nil {
+				break
+			}
+
+			// Don't leave the unused lease behind.
+			e.lease.Revoke(ctx, lease.ID)
+			err = &LeaseError{Kind: ErrLeaseKeepaliveFailed, ID: lease.ID,
+				Err: err}
+		} else {
+			err = &LeaseError{Kind: ErrLeaseGrantFailed, Err: err}
+		}
+
+		if attempt >= e.initAttempts && e.backgroundLease {
+			e.logf("exportedservice: granting lease failed, retrying in "+
+				"the background: %s", err)
+			e.ttl = ttl
+			e.consumers.Add(1)
+			go e.grantInBackground()
+			e.startMaintenance()
+			return nil
+		} else if attempt >= e.initAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return &LeaseError{Kind: ErrLeaseGrantFailed, Err: ctx.Err()}
+		case <-time.After(delay):
+		}
+		delay *= 2
 	}
 
 	e.leaseID = lease.ID
+	e.ttl = ttl
+
+	e.logf("exportedservice: granted lease %016x with ttl %d", e.leaseID,
+		lease.TTL)
+	e.setGrantedTTL(lease.TTL)
+	e.lastKeepalive = time.Now()
+
+	if !e.noKeepalive {
+		e.renewing = true
+
+		e.consumers.Add(1)
+		go e.consumeKeepaliveResponses(e.keepaliveCtx, e.keepaliveResponses)
+	}
 
-	go consumeKeepaliveResponses(e.keepaliveResponses)
+	e.startMaintenance()
 
 	return nil
 }
 
 /*
-NewExportedPort opens a new anonymous port on "ip" and export it through etcd
-as "servicename". If "ip" is not a host:port pair, the port will be chosen at
-random.
+startMaintenance starts the background tasks configured for the exporter
+which don't depend on the lease, like refreshing exports.
 */
-func (e *ServiceExporter) NewExportedPort(
-	ctx context.Context, network, ip, service string) (net.Listener, error) {
-	var path string
-	var host, hostport string
-	var l net.Listener
-	var err error
-
-	if _, _, err = net.SplitHostPort(ip); err != nil {
-		// Apparently, it's not in host:port format.
-		host = ip
-		hostport = net.JoinHostPort(host, "0")
-	} else {
-		hostport = ip
+func (e *ServiceExporter) startMaintenance() {
+	if e.refreshInterval > 0 {
+		e.consumers.Add(1)
+		go e.refreshExports(e.keepaliveCtx)
 	}
 
-	if l, err = net.Listen(network, hostport); err != nil {
-		return nil, err
+	if e.endpointSyncInterval > 0 && e.conn != nil {
+		e.consumers.Add(1)
+		go e.syncEndpoints(e.keepaliveCtx)
 	}
+}
+
+/*
+LeaseID returns the ID of the etcd lease ports are exported with. Other keys
+written with etcd.WithLease(e.LeaseID()) will expire together with the
+exported ports.
+*/
+func (e *ServiceExporter) LeaseID() etcd.LeaseID {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
 
-	// Use the lease ID as part of the path; it would be reasonable to expect
-	// it to be unique.
-	path = fmt.Sprintf("/ns/service/%s/%16x", service, e.leaseID)
+	return e.leaseID
+}
 
-	// Now write our host:port pair to etcd. Let etcd choose the file name.
-	_, err = e.conn.Put(ctx, path, l.Addr().String(), etcd.WithLease(e.leaseID))
-	if err != nil {
-		return nil, err
-	}
+/*
+Client returns the etcd client used by the exporter, e.g. for custom etcd
+operations with the same connection and credentials. The client is closed
+along with the exporter.
+*/
+func (e *ServiceExporter) Client() *etcd.Client {
+	return e.conn
+}
 
-	e.path = path
+/*
+LastKeepalive returns the time the lease was last renewed, or granted if no
+renewal has happened yet.
+*/
+func (e *ServiceExporter) LastKeepalive() time.Time {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
 
-	return l, nil
+	return e.lastKeepalive
 }
 
 /*
-NewExportedTLSPort opens a new anonymous port on "ip" and export it through
-etcd as "servicename" (see NewExportedPort). Associates the TLS configuration
-"config". If "ip" is a host:port pair, the port will be overridden.
+GrantedTTL returns the TTL of the lease in seconds as granted by etcd, which
+may differ from the requested one if the server enforces limits of its own.
 */
-func (e *ServiceExporter) NewExportedTLSPort(
-	ctx context.Context, network, ip, servicename string,
-	config *tls.Config) (net.Listener, error) {
-	var l net.Listener
-	var err error
+func (e *ServiceExporter) GrantedTTL() int64 {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
 
-	// We can just create a new port as above...
-	l, err = e.NewExportedPort(ctx, network, ip, servicename)
-	if err != nil {
-		return nil, err
-	}
+	return e.grantedTTL
+}
 
-	// ... and inject a TLS context.
-	return tls.NewListener(l, config), nil
+/*
+ReportedTTL returns the TTL of the lease in seconds as reported by etcd in
+response to the most recent renewal, or 0 if the lease hasn't been renewed
+yet. A TTL which keeps dropping below the granted one (see GrantedTTL)
+indicates that renewals are failing.
+*/
+func (e *ServiceExporter) ReportedTTL() int64 {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	return e.reportedTTL
 }
 
 /*
-UnexportPort removes the associated exported port. This will only delete the
-most recently exported port. Exported ports will disappear by themselves once
-the process dies, but this will expedite the process.
+Deadline returns the time at which the lease, and with it the exported ports,
+would expire if it isn't renewed again, computed from the time the last
+renewal arrived and the TTL reported with it (or the granted TTL if the lease
+hasn't been renewed yet). Work which has to complete while the ports are
+still registered shouldn't be started if it can't finish before then. Returns
+the zero time if the exporter holds no lease.
 */
-func (e *ServiceExporter) UnexportPort(ctx context.Context) error {
-	var err error
+func (e *ServiceExporter) Deadline() time.Time {
+	var ttl int64
 
-	if len(e.path) == 0 {
-		return nil
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.leaseID == etcd.NoLease {
+		return time.Time{}
 	}
 
-	if _, err = e.conn.Delete(ctx, e.path); err != nil {
-		return err
+	if ttl = e.reportedTTL; ttl == 0 {
+		ttl = e.grantedTTL
 	}
 
-	return nil
+	return e.lastKeepalive.Add(time.Duration(ttl) * time.Second)
+}
+
+/*
+setGrantedTTL records the TTL "ttl" granted by etcd, and logs a warning if it
+differs from the requested one. The caller must hold the lock.
+*/
+func (e *ServiceExporter) setGrantedTTL(ttl int64) {
+	if ttl != e.ttl {
+		e.logf("exportedservice: warning: etcd granted a ttl of %d "+
+			"seconds instead of the requested %d", ttl, e.ttl)
+	}
+
+	e.grantedTTL = ttl
+}
+
+/*
+Ping checks that etcd can actually be reached through the connection of the
+exporter, using a lightweight read, and returns an error if not. This is
+useful for gating startup or in readiness probes.
+*/
+func (e *ServiceExporter) Ping(ctx context.Context) error {
+	var err error
+
+	_, err = e.kv.Get(ctx, e.keyPrefix, etcd.WithCountOnly())
+	return err
+}
+
+/*
+Refresh renews the lease of the exporter immediately, rather than waiting for
+the next automatic renewal, and returns the TTL granted by etcd in seconds.
+This is useful e.g. after the process was paused, to keep the lease from
+expiring before the next scheduled renewal.
+*/
+func (e *ServiceExporter) Refresh(ctx context.Context) (int64, error) {
+	var resp *etcd.LeaseKeepAliveResponse
+	var leaseID etcd.LeaseID
+	var now time.Time
+	var err error
+
+	e.mtx.Lock()
+	if e.closed || e.leaseID == etcd.NoLease {
+		e.mtx.Unlock()
+		return 0, ErrNoLease
+	}
+	leaseID = e.leaseID
+	e.mtx.Unlock()
+
+	if resp, err = e.lease.KeepAliveOnce(ctx, leaseID); err != nil {
+		return 0, err
+	}
+
+	now = time.Now()
+
+	e.mtx.Lock()
+	e.metrics.LeaseRenewed(now.Sub(e.lastKeepalive))
+	e.lastKeepalive = now
+	e.reportedTTL = resp.TTL
+	e.mtx.Unlock()
+
+	return resp.TTL, nil
+}
+
+/*
+IsHealthy returns true if the lease is still being renewed and the last
+renewal happened within the TTL, i.e. exported ports are currently visible in
+etcd. This is useful for readiness probes. With WithoutKeepalive, it returns
+true until the lease expires.
+*/
+func (e *ServiceExporter) IsHealthy() bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.primary != nil {
+		return !e.closed && e.leaseID != etcd.NoLease &&
+			e.primary.LeaseID() == e.leaseID && e.primary.IsHealthy()
+	}
+	if e.borrowedLease {
+		return e.renewing && !e.closed &&
+			time.Since(e.lastKeepalive) < time.Duration(e.grantedTTL)*time.Second
+	}
+
+	return (e.renewing || (e.noKeepalive && e.leaseID != etcd.NoLease)) &&
+		!e.closed &&
+		time.Since(e.lastKeepalive) < time.Duration(e.grantedTTL)*time.Second
+}
+
+/*
+Err returns a channel on which an error is delivered once the lease can no
+longer be renewed (see ErrKeepaliveLost). At that point, exported ports are
+going to disappear from etcd once the lease expires.
+*/
+func (e *ServiceExporter) Err() <-chan error {
+	return e.errors
+}
+
+/*
+servicePath returns the etcd key under which "service" is exported using the
+lease "lease", using the key function if one is configured. If an instance
+name is configured, it is prepended to the lease ID.
+*/
+func (e *ServiceExporter) servicePath(
+	service string, lease etcd.LeaseID) string {
+	if e.keyFunc != nil {
+		return e.keyFunc(service, lease)
+	}
+	if e.instanceName != "" {
+		return fmt.Sprintf("%s/%s/%s-%016x", e.keyPrefix, service,
+			e.instanceName, lease)
+	}
+	return fmt.Sprintf("%s/%s/%016x", e.keyPrefix, service, lease)
+}
+
+/*
+exportPath returns the etcd key for the export "exp".
+*/
+func (e *ServiceExporter) exportPath(exp *export) string {
+	return e.leasePath(exp, e.exportLease(exp))
+}
+
+/*
+leasePath returns the etcd key for the export "exp" when written with the
+lease "lease".
+*/
+func (e *ServiceExporter) leasePath(exp *export, lease etcd.LeaseID) string {
+	return exp.prefix + e.servicePath(exp.service, lease) + exp.suffix
+}
+
+/*
+withShadows returns "exports" followed by the shadow registrations requested
+for them through WithShadowPrefix.
+*/
+func withShadows(exports []*export) []*export {
+	var rv = exports[:len(exports):len(exports)]
+	var exp *export
+
+	for _, exp = range exports {
+		if exp.shadowPrefix == "" {
+			continue
+		}
+		rv = append(rv, &export{
+			service:  exp.service,
+			suffix:   exp.suffix,
+			endpoint: exp.endpoint,
+			lease:    exp.lease,
+			cancel:   exp.cancel,
+			prefix:   exp.shadowPrefix,
+			shadowOf: exp,
+		})
+	}
+
+	return rv
+}
+
+/*
+exportLease returns the ID of the lease the export "exp" is written with.
+*/
+func (e *ServiceExporter) exportLease(exp *export) etcd.LeaseID {
+	if exp.lease != etcd.NoLease {
+		return exp.lease
+	}
+
+	return e.leaseID
+}
+
+/*
+NewExportedPort opens a new anonymous port on "ip" and export it through etcd
+as "servicename". If "ip" is not a host:port pair, the port will be chosen at
+random; it is logged, and can be obtained through ListenerPort or WithBoundPort.
+The options "opts" control how the port is exported; see WithBestEffort for
+serving even while the port can't be exported.
+*/
+func (e *ServiceExporter) NewExportedPort(
+	ctx context.Context, network, ip, service string, opts ...ExportOption) (
+	net.Listener, error) {
+	var l net.Listener
+	var err error
+
+	l, _, err = e.newExportedPort(ctx, network, ip, service, opts)
+	return l, err
+}
+
+/*
+newExportedPort implements NewExportedPort, and also returns the export of
+the new port.
+*/
+func (e *ServiceExporter) newExportedPort(
+	ctx context.Context, network, ip, service string, opts []ExportOption) (
+	net.Listener, *export, error) {
+	var cfg = newExportConfig(opts)
+	var exp *export
+	var l net.Listener
+	var err error
+
+	if l, err = cfg.listen(ctx, network, ip); err != nil {
+		return nil, nil, err
+	}
+	e.logBoundPort([]string{service}, l)
+
+	exp = cfg.export(service, l)
+
+	if cfg.bestEffort {
+		e.consumers.Add(1)
+		go e.exportInBackground(ctx, exp)
+		return l, exp, nil
+	}
+
+	// Now write our host:port pair to etcd.
+	if err = e.commitExports(ctx, []*export{exp}); err != nil {
+		// Don't leak the port if it can't be exported.
+		l.Close()
+		return nil, nil, err
+	}
+
+	return l, exp, nil
+}
+
+/*
+NewExportedPortAsync works like NewExportedPort, but returns the listener as
+soon as the port is open and writes it to etcd in the background, so that
+serving doesn't have to wait for etcd. Once the port has been exported, or
+exporting failed, "done" is called with the result, if it is not nil. The
+listener is left open if exporting fails.
+*/
+func (e *ServiceExporter) NewExportedPortAsync(
+	ctx context.Context, network, ip, service string, done func(error),
+	opts ...ExportOption) (net.Listener, error) {
+	var cfg = newExportConfig(opts)
+	var l net.Listener
+	var err error
+
+	if l, err = cfg.listen(ctx, network, ip); err != nil {
+		return nil, err
+	}
+	e.logBoundPort([]string{service}, l)
+
+	// Close waits for the export to finish.
+	e.consumers.Add(1)
+	go func() {
+		var err error
+
+		defer e.consumers.Done()
+
+		err = e.commitExports(ctx, []*export{cfg.export(service, l)})
+		if err != nil {
+			e.logf("exportedservice: exporting %s: %s", service, err)
+		}
+		if done != nil {
+			done(err)
+		}
+	}()
+
+	return l, nil
+}
+
+/*
+ExportListener exports the existing listener "l" through etcd as "service",
+without opening a new port. This is useful for listeners obtained elsewhere,
+e.g. through socket activation.
+*/
+func (e *ServiceExporter) ExportListener(
+	ctx context.Context, service string, l net.Listener,
+	opts ...ExportOption) error {
+	return e.commitExports(ctx,
+		[]*export{newExportConfig(opts).export(service, l)})
+}
+
+/*
+AdvertiseEndpoint exports the address "addr" through etcd as "service"
+without opening a port, for listeners living in another process, e.g. a
+sidecar proxy. The key is written with the lease of the exporter and removed
+by UnexportPort like those of ports opened by the exporter.
+*/
+func (e *ServiceExporter) AdvertiseEndpoint(
+	ctx context.Context, service, addr string) error {
+	return e.exportEndpoint(ctx, service, &Endpoint{Addr: addr},
+		newExportConfig(nil))
+}
+
+/*
+listen opens a new port on "ip" using "lc", or the default settings if it is
+nil. If "ip" is not a host:port pair, the port will be chosen at random. For
+Unix domain sockets, "ip" is the path of the socket.
+*/
+func listen(ctx context.Context, lc *net.ListenConfig, network, ip string) (
+	net.Listener, error) {
+	var hostport string
+	var err error
+
+	if lc == nil {
+		lc = new(net.ListenConfig)
+	}
+
+	if isUnixNetwork(network) {
+		return lc.Listen(ctx, network, ip)
+	}
+
+	if _, _, err = net.SplitHostPort(ip); err != nil {
+		// Apparently, it's not in host:port format.
+		hostport = net.JoinHostPort(listenHost(ip), "0")
+	} else {
+		hostport = ip
+	}
+
+	return lc.Listen(ctx, network, hostport)
+}
+
+/*
+listenRange opens a new port on the host part of "ip" using "lc" like listen,
+trying the ports from "min" to "max" (inclusive) in turn, starting at a random
+one, until one of them can be bound. Returns ErrPortRangeExhausted, wrapping
+the last error, if all of them are in use. Other errors, e.g. for a host which
+can't be resolved, are returned right away.
+*/
+func listenRange(ctx context.Context, lc *net.ListenConfig, network,
+	ip string, min, max int) (net.Listener, error) {
+	var n = max - min + 1
+	var host string
+	var start int
+	var l net.Listener
+	var i int
+	var err error
+
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+
+	if lc == nil {
+		lc = new(net.ListenConfig)
+	}
+
+	if host, _, err = net.SplitHostPort(ip); err != nil {
+		host = listenHost(ip)
+	}
+
+	// Spread the load when several processes start at the same time.
+	start = rand.Intn(n)
+
+	for i = 0; i < n; i++ {
+		l, err = lc.Listen(ctx, network, net.JoinHostPort(host,
+			strconv.Itoa(min+(start+i)%n)))
+		if err == nil {
+			return l, nil
+		} else if !errors.Is(err, syscall.EADDRINUSE) {
+			// Other ports won't fare any better.
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrPortRangeExhausted, err)
+}
+
+/*
+listenHost returns the host to listen on for "ip" when it's not a host:port
+pair. Bracketed IPv6 literals like "[::1]" must lose their brackets, or they
+would be added twice.
+*/
+func listenHost(ip string) string {
+	if strings.HasPrefix(ip, "[") && strings.HasSuffix(ip, "]") {
+		return ip[1 : len(ip)-1]
+	}
+
+	return ip
+}
+
+/*
+isUnixNetwork returns true if "network" refers to Unix domain sockets.
+*/
+func isUnixNetwork(network string) bool {
+	return network == "unix" || network == "unixpacket"
+}
+
+/*
+listenerAddress returns the address of "l" as it is written to etcd. This is
+the host:port pair for IP based listeners, or "unix://<path>" for Unix domain
+sockets.
+*/
+func listenerAddress(l net.Listener) string {
+	if isUnixNetwork(l.Addr().Network()) {
+		return "unix://" + l.Addr().String()
+	}
+
+	return l.Addr().String()
+}
+
+/*
+normalizeAddress returns the host:port pair "addr" in the representation of
+the IP version of "network", see WithAdvertisedNetwork.
+*/
+func normalizeAddress(network, addr string) string {
+	var host, port string
+	var ip, ip4 net.IP
+	var err error
+
+	if host, port, err = net.SplitHostPort(addr); err != nil {
+		return addr
+	}
+	if ip = net.ParseIP(host); ip == nil {
+		return addr
+	}
+	ip4 = ip.To4()
+
+	switch {
+	case strings.HasSuffix(network, "4") && ip4 != nil:
+		return net.JoinHostPort(ip4.String(), port)
+	case strings.HasSuffix(network, "6") && ip4 != nil:
+		// net.IP always formats IPv4-mapped addresses as IPv4.
+		return net.JoinHostPort("::ffff:"+ip4.String(), port)
+	case strings.HasSuffix(network, "4") && ip.IsUnspecified():
+		return net.JoinHostPort(net.IPv4zero.String(), port)
+	}
+
+	return addr
+}
+
+/*
+exportEndpoint writes "ep" to etcd as the exported port for "service" and
+records the export so it can be removed again later. "cfg" holds the export
+options which apply beyond the endpoint, e.g. WithExclusive.
+*/
+func (e *ServiceExporter) exportEndpoint(ctx context.Context, service string,
+	ep *Endpoint, cfg *exportConfig) error {
+	return e.exportEndpoints(ctx, service, []*Endpoint{ep}, cfg)
+}
+
+/*
+exportEndpoints writes all of "eps" to etcd as exported ports for "service"
+in a single transaction and records the exports so they can be removed again
+later. If there is more than one endpoint, the index of the endpoint is
+appended to each key to keep them apart.
+*/
+func (e *ServiceExporter) exportEndpoints(ctx context.Context,
+	service string, eps []*Endpoint, cfg *exportConfig) error {
+	return e.exportEndpointsWithLease(ctx, service, eps, cfg, etcd.NoLease,
+		nil)
+}
+
+/*
+exportEndpointsWithLease works like exportEndpoints, but writes the endpoints
+with the lease "lease" instead of the lease of the exporter, unless it is
+NoLease. "cancel" stops the renewal of the lease once the exports are removed.
+*/
+func (e *ServiceExporter) exportEndpointsWithLease(
+	ctx context.Context, service string, eps []*Endpoint, cfg *exportConfig,
+	lease etcd.LeaseID, cancel context.CancelFunc) error {
+	var exports = make([]*export, len(eps))
+	var ep *Endpoint
+	var i int
+
+	for i, ep = range eps {
+		exports[i] = &export{
+			service:      service,
+			endpoint:     ep,
+			lease:        lease,
+			cancel:       cancel,
+			exclusive:    cfg.exclusive,
+			shadowPrefix: cfg.shadowPrefix,
+		}
+		if len(eps) > 1 {
+			exports[i].suffix = fmt.Sprintf("-%d", i)
+		}
+	}
+
+	return e.commitExports(ctx, exports)
+}
+
+/*
+commitExports writes all of "exports" to etcd in a single transaction and
+records them so they can be removed again later. The lock is not held while
+writing, so that retrying the write doesn't block the rest of the exporter.
+*/
+func (e *ServiceExporter) commitExports(
+	ctx context.Context, exports []*export) error {
+	var ops []etcd.Op
+	var cmps []etcd.Cmp
+	var own []etcd.Op
+	var paths []string
+	var resp *etcd.TxnResponse
+	var lease, leaseID etcd.LeaseID
+	var exclusive *export
+	var i int
+	var err error
+
+	e.mtx.Lock()
+	exports = withShadows(exports)
+	ops = make([]etcd.Op, len(exports))
+	paths = make([]string, len(exports))
+	leaseID = e.leaseID
+
+	for i = range exports {
+		lease = exports[i].lease
+		if e.closed || (lease == etcd.NoLease && e.leaseID == etcd.NoLease) {
+			e.mtx.Unlock()
+			return ErrNoLease
+		}
+
+		if err = e.checkServiceName(exports[i].service); err != nil {
+			e.mtx.Unlock()
+			return err
+		}
+
+		if e.requireRoutable {
+			if err = checkRoutable(exports[i].endpoint.Addr); err != nil {
+				e.mtx.Unlock()
+				return err
+			}
+		}
+
+		if err = e.encodeExport(exports[i]); err != nil {
+			e.mtx.Unlock()
+			return err
+		}
+
+		// Use the lease ID as part of the path; it would be reasonable to
+		// expect it to be unique.
+		paths[i] = e.exportPath(exports[i])
+		ops[i] = etcd.OpPut(paths[i], exports[i].value,
+			etcd.WithLease(e.exportLease(exports[i])))
+
+		if exports[i].exclusive && e.keyFunc != nil {
+			// Custom keys can't be told apart by service.
+			e.mtx.Unlock()
+			return ErrExclusiveKeyFunc
+		} else if exports[i].exclusive {
+			// No key of the service may exist at all.
+			cmps = append(cmps, etcd.Compare(etcd.CreateRevision(
+				e.servicePrefix(exports[i].service)), "=", 0).WithPrefix())
+		}
+		if exports[i].exclusive && exclusive == nil {
+			exclusive = exports[i]
+			own = []etcd.Op{etcd.OpGet(paths[i])}
+		}
+	}
+	e.mtx.Unlock()
+
+	resp, err = e.commitTxn(ctx, func() etcd.Txn {
+		return e.kv.Txn(ctx).If(cmps...).Then(ops...).Else(own...)
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded && !ownsKey(resp, exclusive) {
+		return ErrAlreadyRegistered
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.closed || e.leaseID != leaseID {
+		// The lease went away while we were writing.
+		for i = range paths {
+			e.kv.Delete(ctx, paths[i])
+		}
+		return ErrNoLease
+	}
+
+	if e.exports == nil {
+		e.exports = make(map[string]*export)
+	}
+	e.notifyExports()
+	for i = range exports {
+		e.exports[paths[i]] = exports[i]
+		e.logf("exportedservice: exported %s at %s = %s",
+			exports[i].service, paths[i], exports[i].value)
+		e.emit(Event{Type: EventRegistered,
+			LeaseID: e.exportLease(exports[i]),
+			Service: exports[i].service, Key: paths[i]})
+	}
+	e.metrics.ExportedPorts(len(e.exports))
+
+	return nil
+}
+
+/*
+ownsKey returns true if the failed transaction "resp" of commitExports found
+the key of "exp" already written by us, i.e. an earlier attempt which was
+reported as failed actually committed. Since the key contains the lease ID,
+nobody else writes it.
+*/
+func ownsKey(resp *etcd.TxnResponse, exp *export) bool {
+	var kvs []*mvccpb.KeyValue
+
+	if exp == nil || len(resp.Responses) == 0 ||
+		resp.Responses[0].GetResponseRange() == nil {
+		return false
+	}
+
+	kvs = resp.Responses[0].GetResponseRange().Kvs
+	return len(kvs) == 1 && string(kvs[0].Value) == exp.value
+}
+
+/*
+checkServiceName returns ErrInvalidServiceName if "service" doesn't match the
+configured pattern or, by default, is empty or contains slashes, whitespace
+or control characters, which would break the structure of the key.
+*/
+func (e *ServiceExporter) checkServiceName(service string) error {
+	if e.serviceNamePattern != nil {
+		if !e.serviceNamePattern.MatchString(service) {
+			return fmt.Errorf("%w: %q", ErrInvalidServiceName, service)
+		}
+		return nil
+	}
+
+	if service == "" || strings.IndexFunc(service, func(r rune) bool {
+		return r == '/' || unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidServiceName, service)
+	}
+
+	return nil
+}
+
+/*
+checkRoutable returns ErrUnroutableAddress if the advertised address "addr"
+refers to a loopback or link-local IP address. Host names and Unix domain
+sockets are not checked.
+*/
+func checkRoutable(addr string) error {
+	var host string
+	var ip net.IP
+	var err error
+
+	if strings.HasPrefix(addr, "unix://") {
+		return nil
+	}
+
+	if host, _, err = net.SplitHostPort(stripScheme(addr)); err != nil {
+		return nil
+	}
+
+	if ip = net.ParseIP(host); ip == nil {
+		return nil
+	}
+
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return fmt.Errorf("%w: %s", ErrUnroutableAddress, addr)
+	}
+
+	return nil
+}
+
+/*
+encodeExport encodes the endpoint of "exp" for writing it to etcd, using the
+custom encoder if one is configured. If registration timestamps are enabled,
+the current time is recorded in the endpoint first.
+*/
+func (e *ServiceExporter) encodeExport(exp *export) error {
+	var data []byte
+	var err error
+
+	if e.encoder != nil {
+		data, err = e.encoder.Encode(exp.endpoint.Addr, exp.endpoint.Meta)
+		exp.value = string(data)
+		return err
+	}
+
+	if e.refreshInterval > 0 {
+		exp.endpoint.SchemaVersion = EndpointSchemaVersion
+		exp.endpoint.RegisteredAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	exp.value, err = encodeEndpoint(exp.endpoint)
+	return err
+}
+
+/*
+refreshExports writes all exports to etcd again every refreshInterval, so
+that their registration timestamp is kept up to date, until "ctx" is done.
+The lock is not held while writing, so that an unavailable etcd doesn't
+block the rest of the exporter; each round is given up after refreshInterval.
+*/
+func (e *ServiceExporter) refreshExports(ctx context.Context) {
+	var ticker = time.NewTicker(e.refreshInterval)
+
+	defer e.consumers.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		e.refreshOnce(ctx)
+	}
+}
+
+/*
+refreshOnce writes all exports to etcd again, see refreshExports.
+*/
+func (e *ServiceExporter) refreshOnce(ctx context.Context) {
+	var exports = make(map[string]*export)
+	var values = make(map[string]string)
+	var leases = make(map[string]etcd.LeaseID)
+	var cancel context.CancelFunc
+	var path string
+	var exp *export
+	var err error
+
+	e.mtx.Lock()
+	for path, exp = range e.exports {
+		if err = e.encodeExport(exp); err != nil {
+			continue
+		}
+		exports[path] = exp
+		values[path] = exp.value
+		leases[path] = e.exportLease(exp)
+	}
+	e.mtx.Unlock()
+
+	ctx, cancel = context.WithTimeout(ctx, e.refreshInterval)
+	defer cancel()
+
+	for path, exp = range exports {
+		if _, err = e.kv.Put(ctx, path, values[path],
+			etcd.WithLease(leases[path])); err != nil {
+			continue
+		}
+
+		e.mtx.Lock()
+		if e.exports[path] != exp {
+			// Unexported while we were writing it.
+			e.mtx.Unlock()
+			e.kv.Delete(ctx, path)
+			continue
+		}
+		e.mtx.Unlock()
+	}
+}
+
+/*
+NewExportedPortMulti opens a new anonymous port on all interfaces and exports
+it through etcd as "service" once for every host in "addrs", e.g. for the
+internal and external address of a multi-homed machine. IPv6 literals may be
+given with or without brackets. All keys share the lease of the exporter. The
+options "opts" control how the port is opened and exported like for
+NewExportedPort, except that the advertised host is taken from "addrs".
+*/
+func (e *ServiceExporter) NewExportedPortMulti(
+	ctx context.Context, network string, addrs []string, service string,
+	opts ...ExportOption) (net.Listener, error) {
+	var cfg = newExportConfig(opts)
+	var eps = make([]*Endpoint, len(addrs))
+	var hostCfg exportConfig
+	var l net.Listener
+	var i int
+	var err error
+
+	if l, err = cfg.listen(ctx, network, ""); err != nil {
+		return nil, err
+	}
+	e.logBoundPort([]string{service}, l)
+
+	for i = range addrs {
+		hostCfg = *cfg
+		hostCfg.advertisedAddr = ""
+		hostCfg.advertisedHost = listenHost(addrs[i])
+		eps[i] = hostCfg.endpoint(l)
+	}
+
+	if err = e.exportEndpoints(ctx, service, eps, cfg); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+/*
+NewExportedPortWithTTL works like NewExportedPort, but exports the port with
+a lease of its own with the TTL "ttl" (in seconds, at least MinTTL), which is
+renewed independently of the lease of the exporter. This allows e.g. exporting
+a short-lived debug port alongside a stable service. The lease is revoked once
+the port is unexported. Automatic re-exporting (see WithAutoReExport) does not
+apply to such ports.
+*/
+func (e *ServiceExporter) NewExportedPortWithTTL(
+	ctx context.Context, network, ip, service string, ttl int64,
+	opts ...ExportOption) (net.Listener, error) {
+	var cfg = newExportConfig(opts)
+	var lease *etcd.LeaseGrantResponse
+	var ch <-chan *etcd.LeaseKeepAliveResponse
+	var keepaliveCtx context.Context
+	var cancel context.CancelFunc
+	var l net.Listener
+	var err error
+
+	if err = checkTTL(ttl); err != nil {
+		return nil, err
+	}
+
+	if l, err = cfg.listen(ctx, network, ip); err != nil {
+		return nil, err
+	}
+
+	if lease, err = e.lease.Grant(ctx, ttl); err != nil {
+		l.Close()
+		return nil, &LeaseError{Kind: ErrLeaseGrantFailed, Err: err}
+	}
+
+	// Renewal stops along with that of the exporter.
+	keepaliveCtx, cancel = context.WithCancel(e.keepaliveCtx)
+	if !e.noKeepalive {
+		ch, err = e.keepAlive(keepaliveCtx, lease.ID, lease.TTL)
+		if err != nil {
+			cancel()
+			e.lease.Revoke(ctx, lease.ID)
+			l.Close()
+			return nil, &LeaseError{Kind: ErrLeaseKeepaliveFailed,
+				ID: lease.ID, Err: err}
+		}
+
+		e.consumers.Add(1)
+		go func() {
+			defer e.consumers.Done()
+			for _ = range ch {
+			}
+		}()
+	}
+
+	err = e.exportEndpointsWithLease(ctx, service,
+		[]*Endpoint{cfg.endpoint(l)}, cfg, lease.ID, cancel)
+	if err != nil {
+		cancel()
+		e.lease.Revoke(ctx, lease.ID)
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+/*
+NewExportedTLSPort opens a new anonymous port on "ip" and export it through
+etcd as "servicename" (see NewExportedPort). Associates the TLS configuration
+"config". If "ip" is a host:port pair, the port will be overridden.
+
+The port is exported as an Endpoint carrying the metadata MetaTLS, so that
+clients know to connect using TLS, along with the ALPN protocols
+(MetaALPNProtocols) and minimum TLS version (MetaTLSMinVersion) from "config",
+if set.
+*/
+func (e *ServiceExporter) NewExportedTLSPort(
+	ctx context.Context, network, ip, servicename string,
+	config *tls.Config, opts ...ExportOption) (net.Listener, error) {
+	var l net.Listener
+	var err error
+
+	// We can just create a new port as above...
+	l, err = e.newExportedEndpoint(ctx, network, ip, servicename,
+		&Endpoint{Meta: tlsMetadata(config)}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// ... and inject a TLS context.
+	return tls.NewListener(l, config), nil
+}
+
+// ExportInfo describes a port exported through a ServiceExporter, as
+// returned by Exports.
+type ExportInfo struct {
+	// Service is the name the port is exported as.
+	Service string
+
+	// Key is the etcd key the port is exported under.
+	Key string
+
+	// Addr is the advertised address of the port.
+	Addr string
+
+	// Value is the value written to etcd, see ParseEndpoint.
+	Value string
+
+	// LeaseID is the lease the key is bound to.
+	LeaseID etcd.LeaseID
+}
+
+/*
+Exports returns a snapshot of all ports currently exported through this
+exporter, sorted by key, e.g. for a debug page. The information is taken from
+the state of the exporter; etcd is not consulted.
+*/
+func (e *ServiceExporter) Exports() []ExportInfo {
+	var rv []ExportInfo
+	var path string
+	var exp *export
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for path, exp = range e.exports {
+		rv = append(rv, ExportInfo{
+			Service: exp.service,
+			Key:     path,
+			Addr:    exp.endpoint.Addr,
+			Value:   exp.value,
+			LeaseID: e.exportLease(exp),
+		})
+	}
+
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Key < rv[j].Key })
+
+	return rv
+}
+
+/*
+ReexportPort points the existing export of "service" at the new listener "l",
+e.g. after the port had to be opened again, by overwriting the value of its
+etcd key, and those of its shadow registrations (see WithShadowPrefix), in a
+single transaction. Unlike unexporting and exporting again, this
+leaves no window in which the service can't be discovered. The options "opts"
+control how the new address is exported. Returns ErrNotExported unless
+exactly one port is exported as "service".
+*/
+func (e *ServiceExporter) ReexportPort(ctx context.Context, service string,
+	l net.Listener, opts ...ExportOption) error {
+	var found, exp *export
+	var exports []*export
+	var updated export
+	var ops []etcd.Op
+	var paths []string
+	var leaseID etcd.LeaseID
+	var i int
+	var err error
+
+	e.mtx.Lock()
+	for _, exp = range e.exports {
+		if exp.service != service || exp.shadowOf != nil {
+			continue
+		}
+		if found != nil {
+			e.mtx.Unlock()
+			return ErrNotExported
+		}
+		found = exp
+	}
+	if found == nil || e.closed {
+		e.mtx.Unlock()
+		return ErrNotExported
+	}
+
+	// Only touch the export once the new value has been written.
+	updated = *found
+	updated.endpoint = new(Endpoint)
+	*updated.endpoint = *found.endpoint
+	updated.endpoint.Addr = newExportConfig(opts).address(l)
+
+	if e.requireRoutable {
+		if err = checkRoutable(updated.endpoint.Addr); err != nil {
+			e.mtx.Unlock()
+			return err
+		}
+	}
+
+	if err = e.encodeExport(&updated); err != nil {
+		e.mtx.Unlock()
+		return err
+	}
+
+	// Shadow registrations follow the port they shadow.
+	exports = []*export{found}
+	for _, exp = range e.exports {
+		if exp.shadowOf == found {
+			exports = append(exports, exp)
+		}
+	}
+	for _, exp = range exports {
+		paths = append(paths, e.exportPath(exp))
+		ops = append(ops, etcd.OpPut(e.exportPath(exp), updated.value,
+			etcd.WithLease(e.exportLease(exp))))
+	}
+	leaseID = e.leaseID
+	e.mtx.Unlock()
+
+	if _, err = e.kv.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	if e.closed || e.leaseID != leaseID || e.exports[paths[0]] != found {
+		e.mtx.Unlock()
+
+		// Unexported or re-exported with a new lease while we were
+		// writing; the keys we wrote are stale.
+		for i = range paths {
+			e.kv.Delete(ctx, paths[i])
+		}
+		return ErrNotExported
+	}
+
+	for _, exp = range exports {
+		exp.endpoint = updated.endpoint
+		exp.value = updated.value
+	}
+
+	e.logf("exportedservice: re-exported %s at %s = %s", service,
+		paths[0], found.value)
+	e.emit(Event{Type: EventRegistered, LeaseID: e.exportLease(found),
+		Service: service, Key: paths[0]})
+	e.mtx.Unlock()
+
+	return nil
+}
+
+/*
+ExportedPath returns the etcd key under which "service" was exported through
+this exporter. The second return value is false if no such export exists.
+*/
+func (e *ServiceExporter) ExportedPath(service string) (string, bool) {
+	var path string
+	var exp *export
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for path, exp = range e.exports {
+		if exp.service == service && exp.shadowOf == nil {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+/*
+UnexportPort removes all ports exported through this exporter from etcd and
+returns the number of keys which were actually deleted. Keys which are already
+gone, e.g. because the lease expired, are not an error. Exported ports will
+disappear by themselves once the process dies, but this will expedite the
+process. Calling UnexportPort again is a no-op.
+*/
+func (e *ServiceExporter) UnexportPort(ctx context.Context) (int64, error) {
+	return e.unexport(ctx, func(*export) bool { return true })
+}
+
+/*
+UnexportPortByName removes the port exported as "service" from etcd, leaving
+any other ports exported through this exporter in place. Returns the number of
+keys which were actually deleted, like UnexportPort.
+*/
+func (e *ServiceExporter) UnexportPortByName(
+	ctx context.Context, service string) (int64, error) {
+	return e.unexport(ctx, func(exp *export) bool {
+		return exp.service == service
+	})
+}
+
+/*
+unexport removes all exports for which "match" returns true from etcd and
+returns the number of keys deleted. The lock is not held while deleting, so
+that an unavailable etcd doesn't block the rest of the exporter; exports
+whose keys couldn't be deleted are kept, so that unexporting can be retried.
+*/
+func (e *ServiceExporter) unexport(
+	ctx context.Context, match func(*export) bool) (int64, error) {
+	var matched = make(map[string]*export)
+	var resp *etcd.DeleteResponse
+	var leaseID, lease etcd.LeaseID
+	var deleted int64
+	var path string
+	var exp *export
+	var err error
+
+	// Forget the exports first, so they aren't written again while we
+	// delete their keys without holding the lock.
+	e.mtx.Lock()
+	for path, exp = range e.exports {
+		if match(exp) {
+			matched[path] = exp
+			delete(e.exports, path)
+		}
+	}
+	leaseID = e.leaseID
+	e.metrics.ExportedPorts(len(e.exports))
+	e.mtx.Unlock()
+
+	for path, exp = range matched {
+		if resp, err = e.kv.Delete(ctx, path); err != nil {
+			break
+		}
+		deleted += resp.Deleted
+		delete(matched, path)
+
+		if lease = exp.lease; lease == etcd.NoLease {
+			lease = leaseID
+		}
+		e.logf("exportedservice: unexported %s at %s", exp.service, path)
+		e.emit(Event{Type: EventUnregistered, LeaseID: lease,
+			Service: exp.service, Key: path})
+
+		// Ports with a lease of their own don't need it anymore.
+		if exp.lease != etcd.NoLease {
+			exp.cancel()
+			e.lease.Revoke(ctx, exp.lease)
+		}
+	}
+
+	if err != nil {
+		// Keep what is still in etcd, so unexporting can be retried.
+		e.mtx.Lock()
+		if !e.closed && e.leaseID == leaseID {
+			for path, exp = range matched {
+				e.exports[path] = exp
+			}
+		}
+		e.metrics.ExportedPorts(len(e.exports))
+		e.mtx.Unlock()
+		return deleted, err
+	}
+
+	return deleted, nil
+}
+
+/*
+Drain removes all ports exported through this exporter from discovery,
+including addresses added to aggregated keys, but leaves the listeners open
+and the lease in place. This allows finishing in-flight requests during a
+rolling deployment: clients stop picking the instance, and the caller can shut
+its servers down after a grace period, e.g. using http.Server.Shutdown.
+*/
+func (e *ServiceExporter) Drain(ctx context.Context) error {
+	var err error
+
+	e.logf("exportedservice: draining")
+
+	if _, err = e.UnexportPort(ctx); err != nil {
+		return err
+	}
+
+	return e.removeAllAggregated(ctx)
+}
+
+/*
+DeregisterAll removes all ports exported through this exporter from etcd,
+including addresses added to aggregated keys, and revokes the lease, so that
+the process leaves no trace in etcd immediately rather than after the TTL.
+Lease renewal stops without ErrKeepaliveLost being reported, and no further
+ports can be exported; the etcd client remains open (see Close).
+*/
+func (e *ServiceExporter) DeregisterAll(ctx context.Context) error {
+	var leaseID etcd.LeaseID
+	var borrowed bool
+	var err error
+
+	if _, err = e.UnexportPort(ctx); err != nil {
+		return err
+	}
+
+	if err = e.removeAllAggregated(ctx); err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	if e.closed || e.leaseID == etcd.NoLease {
+		e.mtx.Unlock()
+		return nil
+	}
+
+	if e.cancelKeepalive != nil {
+		e.cancelKeepalive()
+	}
+
+	leaseID = e.leaseID
+	borrowed = e.borrowedLease
+	e.leaseID = etcd.NoLease
+	e.mtx.Unlock()
+
+	// A borrowed lease is left to its owner. Otherwise, the lease expires
+	// by itself if revoking fails, as it isn't renewed anymore.
+	if !borrowed {
+		if _, err = e.lease.Revoke(ctx, leaseID); err != nil {
+			return err
+		}
+
+		e.logf("exportedservice: revoked lease %016x", leaseID)
+	}
+
+	return nil
+}
+
+/*
+Close revokes the lease held by the exporter, which removes all ports exported
+through it from etcd, and releases the etcd client. This also stops the
+background lease renewal and waits for it to finish. After Close, the exporter
+can no longer be used to export ports.
+
+It is safe to call Close multiple times, and on an exporter whose lease could
+not be initialized.
+*/
+func (e *ServiceExporter) Close(ctx context.Context) error {
+	var err error
+
+	// Stop renewal before taking the lock, so that a pending re-export
+	// gives up instead of keeping us waiting for etcd.
+	if e.cancelKeepalive != nil {
+		e.cancelKeepalive()
+	}
+
+	// Addresses in aggregated keys aren't bound to the lease.
+	e.removeAllAggregated(ctx)
+
+	e.mtx.Lock()
+	if e.closed || e.conn == nil {
+		e.mtx.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.notifyExports()
+
+	if e.borrowedLease {
+		// The lease belongs to someone else, so only our keys can go.
+		for path, exp := range e.exports {
+			if exp.lease == etcd.NoLease {
+				if _, derr := e.kv.Delete(ctx, path); err == nil {
+					err = derr
+				}
+			}
+		}
+	} else if e.leaseID != etcd.NoLease {
+		_, err = e.lease.Revoke(ctx, e.leaseID)
+	}
+
+	for _, exp := range e.exports {
+		if exp.lease != etcd.NoLease {
+			e.lease.Revoke(ctx, exp.lease)
+		}
+	}
+
+	if !e.borrowedLease {
+		if cerr := e.conn.Close(); err == nil {
+			err = cerr
+		}
+	}
+	e.mtx.Unlock()
+
+	// Don't return before renewal has actually stopped, so no goroutines
+	// are left behind.
+	e.consumers.Wait()
+
+	return err
 }
@@ -0,0 +1,394 @@
+package exportedservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func TestServicePathPadsLeaseID(t *testing.T) {
+	var tests = []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, "/ns/service/test/0000000000000abc"},
+		{"instance", []Option{WithInstanceName("web")},
+			"/ns/service/test/web-0000000000000abc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var e = &ServiceExporter{keyPrefix: DefaultKeyPrefix}
+			var opt Option
+			var path string
+
+			for _, opt = range test.opts {
+				opt(e)
+			}
+
+			path = e.servicePath("test", etcd.LeaseID(0xabc))
+			if strings.Contains(path, " ") {
+				t.Errorf("servicePath() = %q, contains spaces", path)
+			}
+			if path != test.want {
+				t.Errorf("servicePath() = %q, want %q", path, test.want)
+			}
+		})
+	}
+}
+
+// failingKV is an etcd.KV whose transactions all fail with err.
+type failingKV struct {
+	etcd.KV
+	err error
+}
+
+func (f failingKV) Txn(ctx context.Context) etcd.Txn {
+	return failingTxn{f.err}
+}
+
+// failingTxn is an etcd.Txn which fails to commit with err.
+type failingTxn struct {
+	err error
+}
+
+func (f failingTxn) If(cs ...etcd.Cmp) etcd.Txn   { return f }
+func (f failingTxn) Then(ops ...etcd.Op) etcd.Txn { return f }
+func (f failingTxn) Else(ops ...etcd.Op) etcd.Txn { return f }
+
+func (f failingTxn) Commit() (*etcd.TxnResponse, error) {
+	return nil, f.err
+}
+
+func TestNewExportedPortClosesListenerOnPutFailure(t *testing.T) {
+	var putErr = errors.New("put failed")
+	var e = newServiceExporter(new(etcd.Client), nil)
+	var sock = filepath.Join(t.TempDir(), "test.sock")
+	var l net.Listener
+	var err error
+
+	e.kv = failingKV{err: putErr}
+	e.leaseID = etcd.LeaseID(0xabc)
+
+	l, err = e.NewExportedPort(context.Background(), "unix", sock, "test")
+	if !errors.Is(err, putErr) {
+		t.Fatalf("NewExportedPort() = %v, %v, want error %v", l, err, putErr)
+	}
+
+	// Closing a Unix domain socket listener removes the socket.
+	if _, err = os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket %s still exists after failed export: %v", sock, err)
+	}
+}
+
+/*
+startEtcd starts an embedded etcd cluster of "members" members on localhost,
+which is shut down when the test finishes, and returns functions stopping each
+member and their client URLs.
+*/
+func startEtcd(t *testing.T, members int) ([]func(), []string) {
+	var cfgs = make([]*embed.Config, members)
+	var servers []*embed.Etcd
+	var stop []func()
+	var endpoints []string
+	var cluster []string
+	var server *embed.Etcd
+	var i int
+	var err error
+
+	for i = range cfgs {
+		var clientURL, peerURL url.URL
+
+		clientURL = url.URL{Scheme: "http", Host: freeLocalAddr(t)}
+		peerURL = url.URL{Scheme: "http", Host: freeLocalAddr(t)}
+
+		cfgs[i] = embed.NewConfig()
+		cfgs[i].Name = fmt.Sprintf("member%d", i)
+		cfgs[i].Dir = t.TempDir()
+		cfgs[i].LogLevel = "error"
+		cfgs[i].ListenClientUrls = []url.URL{clientURL}
+		cfgs[i].AdvertiseClientUrls = []url.URL{clientURL}
+		cfgs[i].ListenPeerUrls = []url.URL{peerURL}
+		cfgs[i].AdvertisePeerUrls = []url.URL{peerURL}
+
+		endpoints = append(endpoints, clientURL.String())
+		cluster = append(cluster, cfgs[i].Name+"="+peerURL.String())
+	}
+
+	for i = range cfgs {
+		cfgs[i].InitialCluster = strings.Join(cluster, ",")
+		if server, err = embed.StartEtcd(cfgs[i]); err != nil {
+			t.Fatalf("starting etcd member %d: %s", i, err)
+		}
+		// Members may be stopped by the test already.
+		stop = append(stop, sync.OnceFunc(server.Close))
+		t.Cleanup(stop[i])
+		servers = append(servers, server)
+	}
+
+	for i, server = range servers {
+		select {
+		case <-server.Server.ReadyNotify():
+		case err = <-server.Err():
+			t.Fatalf("etcd member %d failed: %s", i, err)
+		case <-time.After(time.Minute):
+			t.Fatalf("etcd member %d not ready in time", i)
+		}
+	}
+
+	return stop, endpoints
+}
+
+/*
+freeLocalAddr returns a host:port pair on localhost which is currently not in
+use.
+*/
+func freeLocalAddr(t *testing.T) string {
+	var l net.Listener
+	var err error
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("finding a free port: %s", err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+/*
+clientGoroutines returns the number of goroutines running code of the exporter
+or of an etcd client, i.e. not counting those of the embedded etcd servers.
+*/
+func clientGoroutines() int {
+	var buf = make([]byte, 1<<20)
+	var stack string
+	var rv int
+
+	for len(buf) == runtime.Stack(buf, true) {
+		buf = make([]byte, 2*len(buf))
+	}
+
+	for _, stack = range strings.Split(string(buf[:runtime.Stack(buf, true)]),
+		"\n\n") {
+		if strings.Contains(stack, "exportedservice.Test") {
+			continue
+		}
+		if strings.Contains(stack, "go-etcd-exportedservice.") ||
+			strings.Contains(stack, "go.etcd.io/etcd/client/v3") {
+			rv++
+		}
+	}
+
+	return rv
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	var ctx = context.Background()
+	var e *ServiceExporter
+	var l net.Listener
+	var before int
+	var deadline time.Time
+	var endpoints []string
+	var err error
+
+	_, endpoints = startEtcd(t, 1)
+	before = clientGoroutines()
+
+	e, err = NewExporter(ctx, endpoints[0], 5,
+		WithRegistrationTimestamp(time.Second), WithEndpointSync(time.Second))
+	if err != nil {
+		t.Fatalf("NewExporter() = %v", err)
+	}
+	if l, err = e.NewExportedPort(ctx, "tcp", "127.0.0.1", "test"); err != nil {
+		t.Fatalf("NewExportedPort() = %v", err)
+	}
+	if err = e.Close(ctx); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	l.Close()
+
+	// The connection to etcd takes a moment to be torn down.
+	deadline = time.Now().Add(5 * time.Second)
+	for clientGoroutines() > before && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := clientGoroutines(); n > before {
+		t.Errorf("%d goroutines left after Close, want at most %d", n, before)
+	}
+}
+
+func TestListenHost(t *testing.T) {
+	var tests = []struct {
+		ip, want string
+	}{
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"[::1]:8080", "[::1]:8080"},
+		{"127.0.0.1", "127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		if got := listenHost(test.ip); got != test.want {
+			t.Errorf("listenHost(%q) = %q, want %q", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	var tests []struct{ ip, wantPort string }
+	var l net.Listener
+	var port string
+	var err error
+
+	// Find a port for the host:port case which is free, unlike maybe 8080.
+	if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback not available: %s", err)
+	}
+	_, port, _ = net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	tests = []struct{ ip, wantPort string }{
+		{"::1", ""},
+		{"[::1]", ""},
+		{"[::1]:" + port, port},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			var host, gotPort string
+			var l net.Listener
+			var err error
+
+			l, err = listen(context.Background(), nil, "tcp", test.ip)
+			if err != nil {
+				t.Fatalf("listen(%q) = %v", test.ip, err)
+			}
+			defer l.Close()
+
+			host, gotPort, _ = net.SplitHostPort(l.Addr().String())
+			if host != "::1" {
+				t.Errorf("listen(%q) bound to host %q, want ::1", test.ip, host)
+			}
+			if test.wantPort != "" && gotPort != test.wantPort {
+				t.Errorf("listen(%q) bound to port %s, want %s", test.ip,
+					gotPort, test.wantPort)
+			}
+		})
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	var e *ServiceExporter
+	var l net.Listener
+	var stop []func()
+	var endpoints []string
+	var err error
+
+	defer cancel()
+
+	stop, endpoints = startEtcd(t, 3)
+
+	if e, err = NewExporterWithEndpoints(ctx, endpoints, 5); err != nil {
+		t.Fatalf("NewExporterWithEndpoints() = %v", err)
+	}
+	defer e.Close(context.Background())
+
+	// The remaining members still have a quorum.
+	stop[0]()
+
+	if l, err = e.NewExportedPort(ctx, "tcp", "127.0.0.1", "test"); err != nil {
+		t.Fatalf("NewExportedPort() after stopping %s = %v", endpoints[0], err)
+	}
+	defer l.Close()
+
+	if !e.IsHealthy() {
+		t.Errorf("IsHealthy() = false after stopping %s", endpoints[0])
+	}
+}
+
+func TestListenRangeErrors(t *testing.T) {
+	var l net.Listener
+	var port int
+	var err error
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	defer l.Close()
+	port = ListenerPort(l)
+
+	_, err = listenRange(context.Background(), nil, "tcp", "127.0.0.1",
+		port, port)
+	if !errors.Is(err, ErrPortRangeExhausted) {
+		t.Errorf("listenRange() on a used port = %v, want %v", err,
+			ErrPortRangeExhausted)
+	}
+
+	_, err = listenRange(context.Background(), nil, "tcp", "host.invalid",
+		port, port+10)
+	if err == nil || errors.Is(err, ErrPortRangeExhausted) {
+		t.Errorf("listenRange() on an unresolvable host = %v, want the "+
+			"resolver error", err)
+	}
+}
+
+func TestNewExportedPortMultiBracketedIPv6(t *testing.T) {
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	var e *ServiceExporter
+	var l net.Listener
+	var resp *etcd.GetResponse
+	var endpoints []string
+	var want = make(map[string]bool)
+	var port string
+	var err error
+
+	defer cancel()
+
+	_, endpoints = startEtcd(t, 1)
+
+	if e, err = NewExporter(ctx, endpoints[0], 5); err != nil {
+		t.Fatalf("NewExporter() = %v", err)
+	}
+	defer e.Close(context.Background())
+
+	l, err = e.NewExportedPortMulti(ctx, "tcp",
+		[]string{"[2001:db8::1]", "2001:db8::2", "192.0.2.1"}, "test",
+		WithScheme("http"))
+	if err != nil {
+		t.Fatalf("NewExportedPortMulti() = %v", err)
+	}
+	defer l.Close()
+
+	port = strconv.Itoa(ListenerPort(l))
+	want["http://[2001:db8::1]:"+port] = true
+	want["http://[2001:db8::2]:"+port] = true
+	want["http://192.0.2.1:"+port] = true
+
+	resp, err = e.kv.Get(ctx, e.servicePrefix("test"), etcd.WithPrefix())
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if len(resp.Kvs) != len(want) {
+		t.Fatalf("exported %d keys, want %d", len(resp.Kvs), len(want))
+	}
+	for _, kv := range resp.Kvs {
+		if !want[endpointAddress(kv.Value)] {
+			t.Errorf("unexpected address %q exported", kv.Value)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Package exportedserviceprom provides Prometheus metrics for exportedservice.
+It is kept separate so that users of exportedservice which don't use
+Prometheus aren't forced to depend on it.
+
+Usage:
+
+	m := exportedserviceprom.NewMetrics("myapp")
+	prometheus.MustRegister(m)
+	exporter, err := exportedservice.NewExporter(ctx, url, ttl,
+		exportedservice.WithMetrics(m))
+*/
+package exportedserviceprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements both exportedservice.Metrics and prometheus.Collector.
+type Metrics struct {
+	exportedPorts     prometheus.Gauge
+	keepalives        prometheus.Counter
+	keepaliveFailures prometheus.Counter
+	renewInterval     prometheus.Histogram
+}
+
+/*
+NewMetrics creates a new set of exporter metrics. The metric names are
+prefixed with "namespace".
+*/
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		exportedPorts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exportedservice",
+			Name:      "exported_ports",
+			Help:      "Number of ports currently exported through etcd.",
+		}),
+		keepalives: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exportedservice",
+			Name:      "keepalive_responses_total",
+			Help:      "Number of lease keepalive responses received.",
+		}),
+		keepaliveFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exportedservice",
+			Name:      "keepalive_failures_total",
+			Help:      "Number of times the lease stopped being renewed.",
+		}),
+		renewInterval: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exportedservice",
+			Name:      "lease_renew_interval_seconds",
+			Help:      "Time between consecutive lease renewals.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+}
+
+// ExportedPorts implements exportedservice.Metrics.
+func (m *Metrics) ExportedPorts(n int) {
+	m.exportedPorts.Set(float64(n))
+}
+
+// LeaseRenewed implements exportedservice.Metrics.
+func (m *Metrics) LeaseRenewed(interval time.Duration) {
+	m.keepalives.Inc()
+	m.renewInterval.Observe(interval.Seconds())
+}
+
+// KeepaliveFailed implements exportedservice.Metrics.
+func (m *Metrics) KeepaliveFailed() {
+	m.keepaliveFailures.Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.exportedPorts.Describe(ch)
+	m.keepalives.Describe(ch)
+	m.keepaliveFailures.Describe(ch)
+	m.renewInterval.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.exportedPorts.Collect(ch)
+	m.keepalives.Collect(ch)
+	m.keepaliveFailures.Collect(ch)
+	m.renewInterval.Collect(ch)
+}
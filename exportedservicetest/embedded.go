@@ -0,0 +1,103 @@
+/*
+Package exportedservicetest provides helpers for testing code which uses
+exportedservice, without requiring an external etcd: NewEmbeddedExporter runs
+against an embedded etcd server, while TestExporter only records calls.
+*/
+package exportedservicetest
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+
+	exportedservice "github.com/caoimhechaos/go-etcd-exportedservice"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+/*
+freeLocalURL returns an http URL on localhost with a port which is currently
+not in use.
+*/
+func freeLocalURL() (*url.URL, error) {
+	var l net.Listener
+	var err error
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, nil
+}
+
+/*
+NewEmbeddedExporter starts an embedded etcd server listening on localhost and
+returns an exporter connected to it, so that service registration can be
+tested hermetically. The returned cleanup function closes the exporter, shuts
+the embedded server down and removes its data.
+*/
+func NewEmbeddedExporter(
+	ctx context.Context, ttl int64, opts ...exportedservice.Option) (
+	*exportedservice.ServiceExporter, func(), error) {
+	var exporter *exportedservice.ServiceExporter
+	var clientURL, peerURL *url.URL
+	var cfg = embed.NewConfig()
+	var server *embed.Etcd
+	var cleanup func()
+	var dir string
+	var err error
+
+	if dir, err = ioutil.TempDir("", "exportedservicetest"); err != nil {
+		return nil, nil, err
+	}
+
+	if clientURL, err = freeLocalURL(); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	if peerURL, err = freeLocalURL(); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	cfg.Dir = dir
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	if server, err = embed.StartEtcd(cfg); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	cleanup = func() {
+		if exporter != nil {
+			exporter.Close(context.Background())
+		}
+		server.Close()
+		os.RemoveAll(dir)
+	}
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case err = <-server.Err():
+		cleanup()
+		return nil, nil, err
+	case <-ctx.Done():
+		cleanup()
+		return nil, nil, ctx.Err()
+	}
+
+	exporter, err = exportedservice.NewExporter(
+		ctx, clientURL.String(), ttl, opts...)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return exporter, cleanup, nil
+}
@@ -0,0 +1,275 @@
+package exportedservicetest
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	exportedservice "github.com/caoimhechaos/go-etcd-exportedservice"
+)
+
+// Call records a call to one of the methods of a TestExporter.
+type Call struct {
+	// Method is the name of the method called, e.g. "NewExportedPort".
+	Method string
+
+	// Network and Addr are the network and address the port was requested
+	// on, if any.
+	Network string
+	Addr    string
+
+	// Service is the service name passed to the method, if any.
+	Service string
+
+	// Listener is the port opened by the call, if any.
+	Listener net.Listener
+}
+
+/*
+TestExporter is an in-process implementation of exportedservice.Exporter for
+tests which don't need etcd. It opens real ports, but only records which
+services they are exported as. Export options are ignored. The zero value is
+ready to use.
+*/
+type TestExporter struct {
+	mtx      sync.Mutex
+	calls    []Call
+	exported map[string][]net.Listener
+	closed   bool
+}
+
+var _ exportedservice.Exporter = (*TestExporter)(nil)
+
+/*
+NewTestExporter creates a new TestExporter without any ports exported.
+*/
+func NewTestExporter() *TestExporter {
+	return new(TestExporter)
+}
+
+/*
+Calls returns all calls made to the exporter so far, in order.
+*/
+func (t *TestExporter) Calls() []Call {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return append([]Call(nil), t.calls...)
+}
+
+/*
+Exported returns the addresses of the ports currently exported as
+"service", in the order they were exported.
+*/
+func (t *TestExporter) Exported(service string) []string {
+	var rv []string
+	var l net.Listener
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, l = range t.exported[service] {
+		rv = append(rv, l.Addr().String())
+	}
+
+	return rv
+}
+
+/*
+record appends "call" to the recorded calls and, if it opened a port,
+exports it as its service. The caller must hold the lock.
+*/
+func (t *TestExporter) record(call Call) {
+	t.calls = append(t.calls, call)
+
+	if call.Listener == nil {
+		return
+	}
+	if t.exported == nil {
+		t.exported = make(map[string][]net.Listener)
+	}
+	t.exported[call.Service] = append(t.exported[call.Service],
+		call.Listener)
+}
+
+/*
+export opens a new port on "ip" like ServiceExporter.NewExportedPort and
+records it as exported as "service" by "method".
+*/
+func (t *TestExporter) export(method, network, ip, service string) (
+	net.Listener, error) {
+	var call = Call{Method: method, Network: network, Addr: ip,
+		Service: service}
+	var l net.Listener
+	var err error
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.closed {
+		t.record(call)
+		return nil, exportedservice.ErrNoLease
+	}
+
+	if l, err = net.Listen(network, listenAddress(network, ip)); err != nil {
+		t.record(call)
+		return nil, err
+	}
+
+	call.Listener = l
+	t.record(call)
+
+	return l, nil
+}
+
+/*
+listenAddress returns the address to listen on for "ip", like the exporter
+does: "ip" itself for Unix domain sockets and host:port pairs, or a random
+port on the host "ip" otherwise, with brackets of IPv6 literals removed.
+*/
+func listenAddress(network, ip string) string {
+	var err error
+
+	if network == "unix" || network == "unixpacket" {
+		return ip
+	}
+	if _, _, err = net.SplitHostPort(ip); err == nil {
+		return ip
+	}
+
+	if strings.HasPrefix(ip, "[") && strings.HasSuffix(ip, "]") {
+		ip = ip[1 : len(ip)-1]
+	}
+
+	return net.JoinHostPort(ip, "0")
+}
+
+/*
+NewExportedPort opens a new port on "ip" and records it as exported as
+"service".
+*/
+func (t *TestExporter) NewExportedPort(
+	ctx context.Context, network, ip, service string,
+	opts ...exportedservice.ExportOption) (net.Listener, error) {
+	return t.export("NewExportedPort", network, ip, service)
+}
+
+/*
+NewExportedTLSPort opens a new TLS port on "ip" using "config" and records
+it as exported as "servicename".
+*/
+func (t *TestExporter) NewExportedTLSPort(
+	ctx context.Context, network, ip, servicename string, config *tls.Config,
+	opts ...exportedservice.ExportOption) (net.Listener, error) {
+	var l net.Listener
+	var err error
+
+	l, err = t.export("NewExportedTLSPort", network, ip, servicename)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(l, config), nil
+}
+
+/*
+unexport removes the records of all ports exported as "service", or of all
+ports if "all" is set, and returns their number. The listeners are left
+open. The caller must hold the lock.
+*/
+func (t *TestExporter) unexport(service string, all bool) int64 {
+	var rv int64
+	var name string
+
+	for name = range t.exported {
+		if all || name == service {
+			rv += int64(len(t.exported[name]))
+			delete(t.exported, name)
+		}
+	}
+
+	return rv
+}
+
+/*
+UnexportPort removes all ports from the exported ones.
+*/
+func (t *TestExporter) UnexportPort(ctx context.Context) (int64, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.record(Call{Method: "UnexportPort"})
+	return t.unexport("", true), nil
+}
+
+/*
+UnexportPortByName removes the ports exported as "service" from the exported
+ones.
+*/
+func (t *TestExporter) UnexportPortByName(
+	ctx context.Context, service string) (int64, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.record(Call{Method: "UnexportPortByName", Service: service})
+	return t.unexport(service, false), nil
+}
+
+/*
+ListenAndServeNamedHTTP opens a new port on "addr", records it as exported
+as "servicename" and serves "handler" on it until "ctx" is cancelled. The
+port is then unexported and ctx.Err() is returned.
+*/
+func (t *TestExporter) ListenAndServeNamedHTTP(
+	ctx context.Context, servicename, addr string, handler http.Handler,
+	opts ...exportedservice.ExportOption) error {
+	var srv = &http.Server{Handler: handler}
+	var serveDone = make(chan struct{})
+	var l net.Listener
+	var err error
+
+	l, err = t.export("ListenAndServeNamedHTTP", "tcp", addr, servicename)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-serveDone:
+			return
+		}
+
+		t.mtx.Lock()
+		t.unexport(servicename, false)
+		t.mtx.Unlock()
+
+		srv.Close()
+	}()
+
+	err = srv.Serve(l)
+	close(serveDone)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+/*
+Close removes all ports from the exported ones. Further attempts at exporting
+ports fail with exportedservice.ErrNoLease, like on a closed ServiceExporter.
+*/
+func (t *TestExporter) Close(ctx context.Context) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.record(Call{Method: "Close"})
+	t.unexport("", true)
+	t.closed = true
+
+	return nil
+}
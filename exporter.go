@@ -0,0 +1,29 @@
+package exportedservice
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+/*
+Exporter is the interface of the commonly used methods of ServiceExporter.
+Code which exports ports can depend on Exporter rather than on the concrete
+type, so that a fake can be substituted in tests which don't have access to
+etcd.
+*/
+type Exporter interface {
+	NewExportedPort(ctx context.Context, network, ip, service string,
+		opts ...ExportOption) (net.Listener, error)
+	NewExportedTLSPort(ctx context.Context, network, ip, servicename string,
+		config *tls.Config, opts ...ExportOption) (net.Listener, error)
+	UnexportPort(ctx context.Context) (int64, error)
+	UnexportPortByName(ctx context.Context, service string) (int64, error)
+	ListenAndServeNamedHTTP(ctx context.Context, servicename, addr string,
+		handler http.Handler, opts ...ExportOption) error
+	Close(ctx context.Context) error
+}
+
+// ServiceExporter is the default implementation of Exporter.
+var _ Exporter = (*ServiceExporter)(nil)
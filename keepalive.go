@@ -0,0 +1,95 @@
+package exportedservice
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// errNoKeepaliveChannel is returned by keepAlive if etcd reports success
+// without providing a channel for the keepalive responses. Receiving from
+// the nil channel would block forever, leaving the lease silently unrenewed.
+var errNoKeepaliveChannel = errors.New("etcd returned no keepalive channel")
+
+/*
+keepAlive starts renewing the lease "id" with the TTL "ttl" until "ctx" is
+cancelled. The returned channel is fed with the keepalive responses, and
+closed once the lease can no longer be renewed. Unless jitter is configured,
+this is left to etcd.Lease.KeepAlive.
+*/
+func (e *ServiceExporter) keepAlive(ctx context.Context, id etcd.LeaseID,
+	ttl int64) (<-chan *etcd.LeaseKeepAliveResponse, error) {
+	var ch = make(chan *etcd.LeaseKeepAliveResponse, 1)
+	var resp <-chan *etcd.LeaseKeepAliveResponse
+	var err error
+
+	if e.keepaliveJitter <= 0 {
+		if resp, err = e.lease.KeepAlive(ctx, id); err != nil {
+			return nil, err
+		}
+		if resp == nil {
+			return nil, errNoKeepaliveChannel
+		}
+		return resp, nil
+	}
+
+	e.consumers.Add(1)
+	go e.jitteredKeepAlive(ctx, id, ttl, ch)
+
+	return ch, nil
+}
+
+/*
+jitteredKeepAlive renews the lease "id" using KeepAliveOnce about three times
+per TTL, like etcd.Lease.KeepAlive does, but with every interval varied
+randomly by the configured jitter. The first renewal happens after a random
+fraction of the interval so that the renewals of exporters started at the
+same time spread out. Responses are delivered through "ch", which is closed
+once renewal fails for longer than the TTL or "ctx" is cancelled.
+*/
+func (e *ServiceExporter) jitteredKeepAlive(ctx context.Context,
+	id etcd.LeaseID, ttl int64, ch chan<- *etcd.LeaseKeepAliveResponse) {
+	var interval = time.Duration(ttl) * time.Second / 3
+	var delay = time.Duration(rand.Int63n(int64(interval)))
+	var lastRenewal = time.Now()
+	var resp *etcd.LeaseKeepAliveResponse
+	var timer *time.Timer
+	var err error
+
+	defer e.consumers.Done()
+	defer close(ch)
+
+	for {
+		timer = time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if resp, err = e.lease.KeepAliveOnce(ctx, id); err == nil {
+			lastRenewal = time.Now()
+
+			select {
+			case ch <- resp:
+			default:
+				// Don't block on a slow consumer; only the fact that
+				// renewal works matters.
+			}
+		} else if ctx.Err() != nil {
+			return
+		} else {
+			e.missedRenewal()
+			if time.Since(lastRenewal) >= time.Duration(ttl)*time.Second {
+				return
+			}
+		}
+
+		delay = time.Duration(float64(interval) *
+			(1 + e.keepaliveJitter*(2*rand.Float64()-1)))
+	}
+}
@@ -0,0 +1,45 @@
+package exportedservice
+
+/*
+Logger receives log messages about the lifecycle of the lease and the exported
+ports. It is satisfied by *log.Logger and is easily adapted to other logging
+packages.
+*/
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// nopLogger is the Logger used by default. It discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+
+// loggerHolder wraps a Logger so it can be stored in an atomic.Value, which
+// requires a consistent concrete type.
+type loggerHolder struct {
+	Logger
+}
+
+/*
+SetLogger makes the exporter log lease grants, exports, unexports and keepalive
+loss to "l". Passing nil disables logging again, which is the default. Use
+WithLogger to also log the initial lease grant.
+*/
+func (e *ServiceExporter) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+
+	e.logger.Store(loggerHolder{l})
+}
+
+/*
+logf logs a message to the configured logger, if any.
+*/
+func (e *ServiceExporter) logf(format string, v ...interface{}) {
+	var h, ok = e.logger.Load().(loggerHolder)
+
+	if ok {
+		h.Printf(format, v...)
+	}
+}
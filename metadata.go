@@ -0,0 +1,322 @@
+package exportedservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"strings"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// DefaultWeight is the weight of endpoints exported without an explicit
+// weight, including plain host:port values.
+const DefaultWeight = 1
+
+// EndpointSchemaVersion is the version of the Endpoint encoding written by
+// this package. Plain host:port values are considered to be version 0.
+const EndpointSchemaVersion = 1
+
+// Metadata keys written by NewExportedTLSPort.
+const (
+	// MetaTLS is set to "true" for endpoints which require TLS.
+	MetaTLS = "tls"
+
+	// MetaALPNProtocols lists the ALPN protocols supported by the
+	// endpoint, separated by commas.
+	MetaALPNProtocols = "alpn"
+
+	// MetaTLSMinVersion is the minimum TLS version accepted by the
+	// endpoint, e.g. "1.2".
+	MetaTLSMinVersion = "tls_min_version"
+)
+
+/*
+Endpoint describes an exported port together with its metadata, as written
+to etcd by NewExportedPortWithMetadata and NewExportedPortWithWeight. It is
+encoded as JSON:
+
+	{"schema_version": 1, "addr": "10.0.0.3:44312", "weight": 10,
+	 "meta": {"version": "1.2"}}
+
+The weight is omitted if it was not set explicitly.
+*/
+type Endpoint struct {
+	// SchemaVersion is the version of the encoding the endpoint was read
+	// from, see EndpointSchemaVersion.
+	SchemaVersion int `json:"schema_version"`
+
+	// Addr is the host:port pair the service can be reached at.
+	Addr string `json:"addr"`
+
+	// RegisteredAt is the time the endpoint was last written to etcd, in
+	// RFC 3339 format. It is only set if enabled through
+	// WithRegistrationTimestamp.
+	RegisteredAt string `json:"registered_at,omitempty"`
+
+	// Priority orders endpoints for failover, like the priority of DNS SRV
+	// records: clients should use the endpoints with the lowest priority
+	// and only fall back to higher ones if none of those are reachable.
+	// The default is 0.
+	Priority int `json:"priority,omitempty"`
+
+	// Group identifies a set of endpoints which are alternative ways of
+	// reaching the same instance, e.g. over different protocols; see
+	// ExportGroup. It is empty for endpoints exported on their own.
+	Group string `json:"group,omitempty"`
+
+	// Weight is the relative share of traffic the endpoint should receive
+	// from load balancers. Endpoints without a weight have DefaultWeight.
+	Weight int `json:"weight,omitempty"`
+
+	// Meta holds arbitrary metadata associated with the endpoint.
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+/*
+EndpointEncoder produces the value written to etcd for an exported port from
+its address and metadata, for discovery systems using a format of their own;
+see WithEncoder.
+*/
+type EndpointEncoder interface {
+	Encode(addr string, meta map[string]string) ([]byte, error)
+}
+
+/*
+ParseEndpoint decodes an etcd value written by any of the export functions
+into an Endpoint. Plain host:port values, as written by NewExportedPort, are
+returned as an Endpoint of schema version 0 without metadata. If no weight was
+exported, the weight is set to DefaultWeight.
+*/
+func ParseEndpoint(data []byte) (*Endpoint, error) {
+	var rv = new(Endpoint)
+	var err error
+
+	if !bytes.HasPrefix(data, []byte("{")) {
+		rv.Addr = string(data)
+		rv.Weight = DefaultWeight
+		return rv, nil
+	}
+
+	if err = json.Unmarshal(data, rv); err != nil {
+		return nil, err
+	}
+
+	if rv.Weight == 0 {
+		rv.Weight = DefaultWeight
+	}
+
+	return rv, nil
+}
+
+/*
+encodeEndpoint returns the etcd value for "ep". Endpoints of schema version 0
+are written as the plain address, as understood by all consumers; all others
+are encoded as JSON.
+*/
+func encodeEndpoint(ep *Endpoint) (string, error) {
+	var data []byte
+	var err error
+
+	if ep.SchemaVersion == 0 {
+		return ep.Addr, nil
+	}
+
+	if data, err = json.Marshal(ep); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+/*
+DecodeEndpoint decodes an etcd value written by NewExportedPortWithMetadata
+into an Endpoint.
+
+Deprecated: use ParseEndpoint, which also accepts plain host:port values.
+*/
+func DecodeEndpoint(data []byte) (*Endpoint, error) {
+	return ParseEndpoint(data)
+}
+
+/*
+NewExportedPortWithMetadata works like NewExportedPort, but exports the
+metadata "meta" alongside the address of the port. The value written to etcd
+is a JSON encoded Endpoint; see ParseEndpoint.
+*/
+func (e *ServiceExporter) NewExportedPortWithMetadata(
+	ctx context.Context, network, ip, service string,
+	meta map[string]string, opts ...ExportOption) (net.Listener, error) {
+	return e.newExportedEndpoint(ctx, network, ip, service,
+		&Endpoint{Meta: meta}, opts)
+}
+
+/*
+NewExportedPortWithWeight works like NewExportedPort, but exports the
+load balancing weight "weight" alongside the address of the port. The value
+written to etcd is a JSON encoded Endpoint; see ParseEndpoint.
+*/
+func (e *ServiceExporter) NewExportedPortWithWeight(
+	ctx context.Context, network, ip, service string, weight int,
+	opts ...ExportOption) (net.Listener, error) {
+	return e.newExportedEndpoint(ctx, network, ip, service,
+		&Endpoint{Weight: weight}, opts)
+}
+
+/*
+tlsMetadata returns the endpoint metadata describing the TLS configuration
+"config".
+*/
+func tlsMetadata(config *tls.Config) map[string]string {
+	var meta = map[string]string{MetaTLS: "true"}
+
+	if config == nil {
+		return meta
+	}
+
+	if len(config.NextProtos) > 0 {
+		meta[MetaALPNProtocols] = strings.Join(config.NextProtos, ",")
+	}
+
+	switch config.MinVersion {
+	case tls.VersionTLS10:
+		meta[MetaTLSMinVersion] = "1.0"
+	case tls.VersionTLS11:
+		meta[MetaTLSMinVersion] = "1.1"
+	case tls.VersionTLS12:
+		meta[MetaTLSMinVersion] = "1.2"
+	case tls.VersionTLS13:
+		meta[MetaTLSMinVersion] = "1.3"
+	}
+
+	return meta
+}
+
+/*
+newExportedEndpoint opens a new port on "ip" and exports it as "service",
+writing "ep" with the address of the port filled in as JSON to etcd.
+*/
+func (e *ServiceExporter) newExportedEndpoint(
+	ctx context.Context, network, ip, service string, ep *Endpoint,
+	opts []ExportOption) (net.Listener, error) {
+	var cfg = newExportConfig(opts)
+	var l net.Listener
+	var err error
+
+	if l, err = cfg.listen(ctx, network, ip); err != nil {
+		return nil, err
+	}
+
+	cfg.fillEndpoint(ep, l)
+
+	if err = e.exportEndpoint(ctx, service, ep, cfg); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+/*
+fillEndpoint fills in the address of the listener "l" and the settings of
+"c" in "ep", as written by newExportedEndpoint.
+*/
+func (c *exportConfig) fillEndpoint(ep *Endpoint, l net.Listener) {
+	ep.SchemaVersion = EndpointSchemaVersion
+	ep.Addr = c.address(l)
+	ep.Priority = c.priority
+}
+
+/*
+UpdateMetadata merges "meta" into the metadata of all ports exported as
+"service" and writes them to etcd again in a single transaction, with the
+same keys and leases, without touching the listeners. This is useful for
+advertising capabilities which only become available after startup. Keys
+mapped to an empty value are removed from the metadata. Returns
+ErrNotExported if no port is exported as "service".
+*/
+func (e *ServiceExporter) UpdateMetadata(ctx context.Context, service string,
+	meta map[string]string) error {
+	var found, updated []*export
+	var ops []etcd.Op
+	var paths, stale []string
+	var leaseID etcd.LeaseID
+	var exp *export
+	var k, v string
+	var i int
+	var err error
+
+	e.mtx.Lock()
+	for _, exp = range e.exports {
+		if exp.service == service {
+			found = append(found, exp)
+		}
+	}
+	if len(found) == 0 || e.closed {
+		e.mtx.Unlock()
+		return ErrNotExported
+	}
+
+	// Only touch the exports once the new values have been written.
+	for _, exp = range found {
+		var u = *exp
+
+		u.endpoint = new(Endpoint)
+		*u.endpoint = *exp.endpoint
+		u.endpoint.SchemaVersion = EndpointSchemaVersion
+		u.endpoint.Meta = make(map[string]string)
+		for k, v = range exp.endpoint.Meta {
+			u.endpoint.Meta[k] = v
+		}
+		for k, v = range meta {
+			if v == "" {
+				delete(u.endpoint.Meta, k)
+			} else {
+				u.endpoint.Meta[k] = v
+			}
+		}
+
+		if err = e.encodeExport(&u); err != nil {
+			e.mtx.Unlock()
+			return err
+		}
+
+		updated = append(updated, &u)
+		paths = append(paths, e.exportPath(exp))
+		ops = append(ops, etcd.OpPut(e.exportPath(exp), u.value,
+			etcd.WithLease(e.exportLease(exp))))
+	}
+	leaseID = e.leaseID
+	e.mtx.Unlock()
+
+	if _, err = e.kv.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	for i, exp = range found {
+		if e.closed || e.leaseID != leaseID || e.exports[paths[i]] != exp {
+			// Unexported or re-exported with a new lease while we were
+			// writing; the key we wrote is stale.
+			stale = append(stale, paths[i])
+			continue
+		}
+
+		exp.endpoint = updated[i].endpoint
+		exp.value = updated[i].value
+
+		e.logf("exportedservice: updated metadata of %s at %s = %s",
+			service, paths[i], exp.value)
+		e.emit(Event{Type: EventRegistered, LeaseID: e.exportLease(exp),
+			Service: service, Key: paths[i]})
+	}
+	e.mtx.Unlock()
+
+	for _, k = range stale {
+		e.kv.Delete(ctx, k)
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package exportedservice
+
+import (
+	"time"
+)
+
+/*
+Metrics receives notifications about the activity of a ServiceExporter, e.g.
+to maintain Prometheus metrics (see the exportedserviceprom package). The
+methods are called synchronously from the exporter and must not block.
+*/
+type Metrics interface {
+	// ExportedPorts is called with the number of ports currently exported
+	// whenever it may have changed.
+	ExportedPorts(n int)
+
+	// LeaseRenewed is called for every keepalive response received from
+	// etcd, with the time passed since the previous renewal.
+	LeaseRenewed(interval time.Duration)
+
+	// KeepaliveFailed is called when etcd stops renewing the lease.
+	KeepaliveFailed()
+}
+
+// nopMetrics is the Metrics implementation used by default. It ignores all
+// notifications.
+type nopMetrics struct{}
+
+func (nopMetrics) ExportedPorts(int)          {}
+func (nopMetrics) LeaseRenewed(time.Duration) {}
+func (nopMetrics) KeepaliveFailed()           {}
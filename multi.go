@@ -0,0 +1,109 @@
+package exportedservice
+
+import (
+	"context"
+	"net"
+)
+
+/*
+MultiExporter exports ports to several etcd clusters at once, e.g. one per
+region, so that clients can discover the service through any of them. Every
+cluster is served by a ServiceExporter of its own, which holds and renews a
+separate lease.
+*/
+type MultiExporter struct {
+	exporters []*ServiceExporter
+}
+
+/*
+NewMultiExporter creates a MultiExporter exporting ports through all of
+"exporters", which are usually connected to different etcd clusters.
+*/
+func NewMultiExporter(exporters ...*ServiceExporter) *MultiExporter {
+	return &MultiExporter{exporters: exporters}
+}
+
+/*
+Exporters returns the exporters ports are exported through, e.g. for
+watching their Err channels individually.
+*/
+func (m *MultiExporter) Exporters() []*ServiceExporter {
+	return m.exporters
+}
+
+/*
+NewExportedPort opens a new port on "ip" like ServiceExporter.NewExportedPort
+and exports it as "service" through all exporters. If exporting fails for any
+of them, the port is removed from the others again and closed.
+*/
+func (m *MultiExporter) NewExportedPort(
+	ctx context.Context, network, ip, service string, opts ...ExportOption) (
+	net.Listener, error) {
+	var cfg = newExportConfig(opts)
+	var l net.Listener
+	var addr string
+	var i int
+	var err error
+
+	if l, err = cfg.listen(ctx, network, ip); err != nil {
+		return nil, err
+	}
+	addr = cfg.address(l)
+
+	for i = range m.exporters {
+		err = m.exporters[i].exportEndpoint(ctx, service, cfg.endpoint(l),
+			cfg)
+		if err != nil {
+			// Don't leave the port registered in only some clusters.
+			for i--; i >= 0; i-- {
+				m.exporters[i].unexport(ctx, func(exp *export) bool {
+					return exp.service == service &&
+						exp.endpoint.Addr == addr
+				})
+			}
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+/*
+UnexportPortByName removes the port exported as "service" from all clusters
+and returns the total number of keys deleted. All exporters are tried even if
+some of them fail; the first error is returned.
+*/
+func (m *MultiExporter) UnexportPortByName(
+	ctx context.Context, service string) (int64, error) {
+	var deleted, n int64
+	var e *ServiceExporter
+	var err, uerr error
+
+	for _, e = range m.exporters {
+		n, uerr = e.UnexportPortByName(ctx, service)
+		deleted += n
+		if uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+
+	return deleted, err
+}
+
+/*
+Close closes all exporters, revoking their leases. All exporters are closed
+even if some of them fail; the first error is returned.
+*/
+func (m *MultiExporter) Close(ctx context.Context) error {
+	var e *ServiceExporter
+	var err, cerr error
+
+	for _, e = range m.exporters {
+		if cerr = e.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,639 @@
+package exportedservice
+
+import (
+	"context"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+)
+
+// DefaultKeyPrefix is the etcd key prefix under which services are exported
+// unless configured otherwise.
+const DefaultKeyPrefix = "/ns/service"
+
+// Option configures optional behavior of a ServiceExporter. Options are
+// passed to the constructors, e.g. NewExporter.
+type Option func(*ServiceExporter)
+
+// KeyFunc returns the etcd key under which "service" is exported using the
+// lease "leaseID"; see WithKeyFunc.
+type KeyFunc func(service string, leaseID etcd.LeaseID) string
+
+// ExportOption configures how an individual port is exported. Export options
+// are passed to the export functions, e.g. NewExportedPort.
+type ExportOption func(*exportConfig)
+
+// exportConfig holds the settings for exporting an individual port.
+type exportConfig struct {
+	advertisedAddr string
+	advertisedHost string
+	scheme         string
+	portMin        int
+	portMax        int
+	advertisedNet  string
+	ready          <-chan struct{}
+	priority       int
+	listenConfig   *net.ListenConfig
+	boundPort      func(port int)
+	exclusive      bool
+	shadowPrefix   string
+	bestEffort     bool
+}
+
+/*
+newExportConfig creates the export settings resulting from applying "opts".
+*/
+func newExportConfig(opts []ExportOption) *exportConfig {
+	var rv = new(exportConfig)
+	var opt ExportOption
+
+	for _, opt = range opts {
+		opt(rv)
+	}
+
+	return rv
+}
+
+/*
+address returns the address which should be written to etcd for the
+listener "l".
+*/
+func (c *exportConfig) address(l net.Listener) string {
+	var addr = c.advertisedAddr
+	var port string
+	var err error
+
+	if addr == "" {
+		addr = listenerAddress(l)
+
+		_, port, err = net.SplitHostPort(addr)
+		if c.advertisedHost != "" && err == nil {
+			addr = net.JoinHostPort(c.advertisedHost, port)
+		}
+	}
+
+	if c.advertisedNet != "" {
+		addr = normalizeAddress(c.advertisedNet, addr)
+	}
+
+	if c.scheme != "" {
+		return c.scheme + "://" + addr
+	}
+
+	return addr
+}
+
+/*
+endpoint returns the endpoint which should be written to etcd for the
+listener "l". Endpoints with a priority are JSON encoded.
+*/
+func (c *exportConfig) endpoint(l net.Listener) *Endpoint {
+	var ep = &Endpoint{Addr: c.address(l), Priority: c.priority}
+
+	if c.priority != 0 {
+		ep.SchemaVersion = EndpointSchemaVersion
+	}
+
+	return ep
+}
+
+/*
+export returns the export of the listener "l" as "service".
+*/
+func (c *exportConfig) export(service string, l net.Listener) *export {
+	return &export{
+		service:      service,
+		endpoint:     c.endpoint(l),
+		exclusive:    c.exclusive,
+		shadowPrefix: c.shadowPrefix,
+	}
+}
+
+/*
+listen opens the port to be exported on "ip", within the configured port
+range if there is one.
+*/
+func (c *exportConfig) listen(ctx context.Context, network, ip string) (
+	net.Listener, error) {
+	var l net.Listener
+	var err error
+
+	if c.portMax == 0 || isUnixNetwork(network) {
+		l, err = listen(ctx, c.listenConfig, network, ip)
+	} else {
+		l, err = listenRange(ctx, c.listenConfig, network, ip, c.portMin,
+			c.portMax)
+	}
+
+	if err == nil && c.boundPort != nil {
+		c.boundPort(ListenerPort(l))
+	}
+
+	return l, err
+}
+
+/*
+WithKeyPrefix sets the etcd key prefix under which services are exported.
+Services will be exported as "<prefix>/<service>/<lease ID>" (see also
+WithInstanceName). The default is DefaultKeyPrefix.
+*/
+func WithKeyPrefix(prefix string) Option {
+	return func(e *ServiceExporter) {
+		e.keyPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+/*
+WithEtcdNamespace scopes all etcd operations of the exporter to the etcd
+namespace "prefix", using the wrappers from the clientv3 namespace package.
+The namespace is prepended to all keys written, deleted and watched, in front
+of the key prefix (see WithKeyPrefix).
+*/
+func WithEtcdNamespace(prefix string) Option {
+	return func(e *ServiceExporter) {
+		e.kv = namespace.NewKV(e.kv, prefix)
+		e.lease = namespace.NewLease(e.lease, prefix)
+		e.watcher = namespace.NewWatcher(e.watcher, prefix)
+	}
+}
+
+/*
+WithAutoReExport makes the exporter grant a new lease and export all of its
+ports again if the lease is lost, e.g. because etcd could not be reached for
+longer than the TTL. Re-exporting is retried until it succeeds or the exporter
+is closed. ErrKeepaliveLost is still reported through Err when the lease is
+lost.
+*/
+func WithAutoReExport() Option {
+	return func(e *ServiceExporter) {
+		e.autoReExport = true
+	}
+}
+
+/*
+WithContextBoundRenewal binds the renewal of the lease to the context passed
+to the constructor: once that context is cancelled, the lease is no longer
+renewed and exported ports will disappear from etcd after the TTL. By default,
+the lease is renewed until the exporter is closed.
+*/
+func WithContextBoundRenewal() Option {
+	return func(e *ServiceExporter) {
+		e.contextBoundRenewal = true
+	}
+}
+
+/*
+WithInitRetry makes the constructors try up to "attempts" times to set up the
+etcd lease before giving up, e.g. while etcd is briefly unavailable during a
+rolling restart. The time between attempts starts at "backoff" and doubles
+after every failed attempt. Retrying stops early if the context passed to the
+constructor is cancelled.
+*/
+func WithInitRetry(attempts int, backoff time.Duration) Option {
+	return func(e *ServiceExporter) {
+		e.initAttempts = attempts
+		e.initBackoff = backoff
+	}
+}
+
+/*
+WithWriteRetry makes the export functions try up to "attempts" times to write
+the exported ports to etcd while etcd rejects the write with a transient
+error, e.g. during a leader election. The time between attempts starts at
+"backoff" and doubles after every failed attempt. Retrying stops early if the
+context passed to the export function is done. The default is 5 attempts,
+starting at 100ms; an "attempts" of 1 disables retrying.
+*/
+func WithWriteRetry(attempts int, backoff time.Duration) Option {
+	return func(e *ServiceExporter) {
+		e.writeAttempts = attempts
+		e.writeBackoff = backoff
+	}
+}
+
+/*
+WithAdvertisedAddress makes the export functions write "addr" to etcd instead
+of the address the port is actually bound to, e.g. when clients have to reach
+the service through NAT.
+*/
+func WithAdvertisedAddress(addr string) ExportOption {
+	return func(c *exportConfig) {
+		c.advertisedAddr = addr
+	}
+}
+
+/*
+WithAdvertisedHostname makes the export functions write "host" to etcd in
+place of the IP address the port is bound to, keeping the actual port, e.g.
+so that clients can verify TLS certificates issued for the host name. If
+"host" is empty, the fully qualified name of the machine is used, as far as
+it can be resolved, or else its plain host name. This has no effect on Unix
+domain sockets or together with WithAdvertisedAddress.
+*/
+func WithAdvertisedHostname(host string) ExportOption {
+	return func(c *exportConfig) {
+		if host == "" {
+			host = localHostname()
+		}
+
+		c.advertisedHost = host
+	}
+}
+
+/*
+localHostname returns the fully qualified name of the machine if it can be
+resolved, or else its plain host name. Returns an empty string if not even
+the host name is known.
+*/
+func localHostname() string {
+	var name, cname string
+	var err error
+
+	if name, err = os.Hostname(); err != nil {
+		return ""
+	}
+
+	if cname, err = net.LookupCNAME(name); err != nil || cname == "" {
+		return name
+	}
+
+	return strings.TrimSuffix(cname, ".")
+}
+
+/*
+WithMetrics makes the exporter report its activity to "m". By default, no
+metrics are collected.
+*/
+func WithMetrics(m Metrics) Option {
+	return func(e *ServiceExporter) {
+		e.metrics = m
+	}
+}
+
+/*
+WithScheme prefixes the address written to etcd with "scheme://", e.g.
+"grpc://10.0.0.3:44312", so that clients know which protocol to use. The HTTP
+functions like ListenAndServeNamedHTTP use "http" or "https" by default; an
+empty scheme turns the prefix off again.
+*/
+func WithScheme(scheme string) ExportOption {
+	return func(c *exportConfig) {
+		c.scheme = scheme
+	}
+}
+
+/*
+WithOpTimeout limits every individual etcd operation of the exporter, such as
+writing or deleting a key, granting a lease or looking up its remaining TTL,
+to "d", even if the context passed in has no deadline. Lease renewal and
+watches are not affected.
+*/
+func WithOpTimeout(d time.Duration) Option {
+	return func(e *ServiceExporter) {
+		e.kv = &timeoutKV{KV: e.kv, timeout: d}
+		e.lease = &timeoutLease{Lease: e.lease, timeout: d}
+	}
+}
+
+/*
+WithRegistrationTimestamp records the time of registration in every exported
+endpoint (see Endpoint.RegisteredAt), and writes all exports to etcd again
+every "refresh" to keep the timestamp current, under the same lease. This
+helps spotting stale entries and clock skew. Enabling this makes even plain
+exports use the JSON encoding.
+*/
+func WithRegistrationTimestamp(refresh time.Duration) Option {
+	return func(e *ServiceExporter) {
+		e.refreshInterval = refresh
+	}
+}
+
+/*
+WithLogger makes the exporter log the lifecycle of its lease and ports to "l",
+including the initial lease grant; see SetLogger.
+*/
+func WithLogger(l Logger) Option {
+	return func(e *ServiceExporter) {
+		e.SetLogger(l)
+	}
+}
+
+/*
+WithInstanceName includes the human readable instance name "name" in the etcd
+keys of exported ports, which are then written as
+"<prefix>/<service>/<name>-<lease ID>". This makes it possible to tell which
+host a key belongs to, while the lease ID keeps the key unique. If "name" is
+empty, the host name of the machine is used. Slashes in the name are replaced
+by underscores.
+*/
+func WithInstanceName(name string) Option {
+	return func(e *ServiceExporter) {
+		var err error
+
+		if name == "" {
+			if name, err = os.Hostname(); err != nil {
+				return
+			}
+		}
+
+		e.instanceName = strings.Replace(name, "/", "_", -1)
+	}
+}
+
+/*
+WithoutKeepalive makes the exporter grant its lease without ever renewing it,
+so that exported ports disappear from etcd on their own once the TTL expires.
+This is useful for short lived commands which don't want a renewal goroutine
+to outlive them. The same applies to ports exported with their own TTL.
+*/
+func WithoutKeepalive() Option {
+	return func(e *ServiceExporter) {
+		e.noKeepalive = true
+	}
+}
+
+/*
+WithPortRange makes the export functions open the port within the range from
+"min" to "max" (inclusive) instead of picking a random port, e.g. to satisfy
+firewall rules. Ports in the range are tried until one of them can be bound;
+if none can, ErrPortRangeExhausted is returned. Any port given as part of the
+address to listen on is ignored.
+*/
+func WithPortRange(min, max int) ExportOption {
+	return func(c *exportConfig) {
+		c.portMin = min
+		c.portMax = max
+	}
+}
+
+/*
+WithDryRun makes the exporter log the keys and values it would write to or
+delete from etcd through its logger (see WithLogger) instead of actually
+modifying them, e.g. to check the configuration before pointing it at a
+production cluster. Ports are still opened, and the lease is still granted and
+renewed so the exporter behaves as usual otherwise.
+*/
+func WithDryRun() Option {
+	return func(e *ServiceExporter) {
+		e.kv = &dryRunKV{KV: e.kv, e: e}
+	}
+}
+
+/*
+WithAdvertisedNetwork makes the export functions write the address of the
+port in the representation of "network" to etcd, independently of the network
+the port listens on. With "tcp4" or "udp4", IPv4 addresses are always written
+as e.g. "1.2.3.4:80", even if they are IPv4-mapped IPv6 addresses like
+"[::ffff:1.2.3.4]:80"; with "tcp6" or "udp6", they are always written in the
+IPv4-mapped form. Addresses which can't be represented in the given network
+are written unchanged.
+*/
+func WithAdvertisedNetwork(network string) ExportOption {
+	return func(c *exportConfig) {
+		c.advertisedNet = network
+	}
+}
+
+/*
+WithKeyFunc makes the exporter use "f" to build the etcd keys of exported
+ports, for key conventions which can't be expressed through WithKeyPrefix and
+WithInstanceName. The keys returned must be unique per service and lease. By
+default, keys are built as "<prefix>/<service>/<lease ID>".
+
+ListService, WatchService, DialService and WatchOwnKey still look for keys
+under the key prefix, so they only work if "f" returns keys below
+"<prefix>/<service>/".
+*/
+func WithKeyFunc(f KeyFunc) Option {
+	return func(e *ServiceExporter) {
+		e.keyFunc = f
+	}
+}
+
+/*
+WithKeepaliveJitter varies the interval between lease renewals randomly by up
+to the fraction "jitter" (between 0 and 1) of the interval, and delays the
+first renewal by a random fraction of it, so that the renewals of many
+instances started at the same time, e.g. during a deployment, don't hit etcd
+all at once. Leases are then renewed using KeepAliveOnce on a timer of our
+own rather than etcd.Lease.KeepAlive. Values outside of [0, 1] are clamped to
+that range, so that renewals are never scheduled with a negative delay.
+*/
+func WithKeepaliveJitter(jitter float64) Option {
+	return func(e *ServiceExporter) {
+		switch {
+		case jitter > 1:
+			e.keepaliveJitter = 1
+		case jitter > 0:
+			e.keepaliveJitter = jitter
+		default:
+			// Including NaN.
+			e.keepaliveJitter = 0
+		}
+	}
+}
+
+/*
+WithEncoder makes the exporter use "enc" to encode the values written to etcd
+instead of the plain address or JSON encoding, e.g. for a protobuf based
+discovery format. Only the address and metadata of an endpoint are passed to
+the encoder. ListService, WatchService and DialService can't decode values
+written with a custom encoder.
+*/
+func WithEncoder(enc EndpointEncoder) Option {
+	return func(e *ServiceExporter) {
+		e.encoder = enc
+	}
+}
+
+/*
+WithRequireRoutableAddress makes the export functions fail with
+ErrUnroutableAddress instead of exporting a port whose advertised address is
+a loopback or link-local address, which clients on other hosts can't reach.
+Ports opened by the export functions are closed again in that case.
+*/
+func WithRequireRoutableAddress() Option {
+	return func(e *ServiceExporter) {
+		e.requireRoutable = true
+	}
+}
+
+/*
+WithEndpointSync makes the exporter update the list of etcd endpoints of its
+client with the current members of the cluster every "interval", and again
+before re-exporting after the lease was lost (see WithAutoReExport). This
+allows the client to fail over to members which were added after it was
+created, if the members it knows about go away permanently.
+*/
+func WithEndpointSync(interval time.Duration) Option {
+	return func(e *ServiceExporter) {
+		e.endpointSyncInterval = interval
+	}
+}
+
+/*
+WithReadinessGate makes ListenAndServeNamedHTTP and ListenAndServeNamedHTTPS
+start serving right away, but only export the port once "ready" is closed,
+e.g. after caches have been warmed up, so that no clients are sent to the
+server before it can handle them. If exporting fails at that point, the
+server is closed. Other export functions ignore the gate.
+*/
+func WithReadinessGate(ready <-chan struct{}) ExportOption {
+	return func(c *exportConfig) {
+		c.ready = ready
+	}
+}
+
+/*
+WithRequestMetadata makes the exporter attach the key/value pairs returned by
+"f" for the context of every etcd request as outgoing gRPC metadata, e.g. to
+forward a request ID to an etcd proxy for logging. Background requests such
+as lease renewal see the context they were started with.
+*/
+func WithRequestMetadata(f MetadataFunc) Option {
+	return func(e *ServiceExporter) {
+		e.kv = &metadataKV{KV: e.kv, f: f}
+		e.lease = &metadataLease{Lease: e.lease, f: f}
+	}
+}
+
+/*
+WithPriority exports the port with the failover priority "priority" (see
+Endpoint.Priority). Ports with a priority other than 0 are written as JSON
+encoded Endpoints.
+*/
+func WithPriority(priority int) ExportOption {
+	return func(c *exportConfig) {
+		c.priority = priority
+	}
+}
+
+/*
+WithKeepaliveFailureThreshold sets the number of consecutive failed attempts
+at resuming the renewal of the lease, e.g. after a brief network outage,
+before the lease is considered lost: only then does IsHealthy report false,
+ErrKeepaliveLost get delivered through Err, and re-exporting start (see
+WithAutoReExport). Attempts stop early once etcd reports the lease as
+expired. The default is 3.
+*/
+func WithKeepaliveFailureThreshold(n int) Option {
+	return func(e *ServiceExporter) {
+		e.keepaliveFailureThreshold = n
+	}
+}
+
+/*
+WithServiceNamePattern makes the export functions only accept service names
+matching "pattern", and fail with ErrInvalidServiceName otherwise. By default,
+service names must be non-empty and must not contain slashes, whitespace or
+control characters.
+*/
+func WithServiceNamePattern(pattern *regexp.Regexp) Option {
+	return func(e *ServiceExporter) {
+		e.serviceNamePattern = pattern
+	}
+}
+
+/*
+WithEventBuffer sets the number of lifecycle events buffered for Events to
+"size". If "block" is set, the exporter waits for the consumer to make room
+instead of dropping events once the buffer is full. The consumer then has to
+keep reading from the channel, as the exporter stalls otherwise; in
+particular, the goroutine reading the events must not wait for calls into the
+exporter.
+*/
+func WithEventBuffer(size int, block bool) Option {
+	return func(e *ServiceExporter) {
+		e.events = make(chan Event, size)
+		e.blockOnEvents = block
+	}
+}
+
+/*
+WithListenConfig makes the export functions open ports using "lc", e.g. to
+set socket options like SO_REUSEPORT through its Control function.
+*/
+func WithListenConfig(lc *net.ListenConfig) ExportOption {
+	return func(c *exportConfig) {
+		c.listenConfig = lc
+	}
+}
+
+/*
+WithBoundPort makes the export functions call "f" with the port the listener
+was bound to as soon as it is open, before the port is exported. This is
+mostly useful for ports requested as 0, whose number is chosen by the
+operating system, e.g. to report it in startup logs. Listeners without a
+port, such as Unix domain sockets, are reported as port 0.
+*/
+func WithBoundPort(f func(port int)) ExportOption {
+	return func(c *exportConfig) {
+		c.boundPort = f
+	}
+}
+
+/*
+WithExclusive makes exporting the port fail with ErrAlreadyRegistered if
+another instance of the service is already exported, instead of adding
+another one, so that the registration works like a lock for singleton
+services. The check and the write happen in a single etcd transaction. This
+requires the default key layout: exporters using WithKeyFunc refuse exclusive
+exports with ErrExclusiveKeyFunc.
+*/
+func WithExclusive() ExportOption {
+	return func(c *exportConfig) {
+		c.exclusive = true
+	}
+}
+
+/*
+WithShadowPrefix additionally registers the port under its usual key
+prefixed with "prefix", e.g. "/canary", so that a canary router watching the
+prefixed keys finds the instance while it keeps receiving normal traffic.
+Both keys are written in the same transaction and with the same lease, and
+are removed together when the port is unexported.
+*/
+func WithShadowPrefix(prefix string) ExportOption {
+	return func(c *exportConfig) {
+		c.shadowPrefix = prefix
+	}
+}
+
+/*
+WithBestEffort makes NewExportedPort return the listener as soon as the port
+is open, even if it can't be written to etcd, e.g. for non-critical services
+which should keep serving while etcd is unavailable. Exporting is retried in
+the background with increasing delays until it succeeds, the context passed
+to NewExportedPort is done, or the exporter is closed. Failed attempts are
+only logged.
+
+This only covers etcd becoming unavailable after the exporter was created:
+the constructors fail if they can't get a lease from etcd, unless the
+exporter is created with WithBackgroundLease.
+*/
+func WithBestEffort() ExportOption {
+	return func(c *exportConfig) {
+		c.bestEffort = true
+	}
+}
+
+/*
+WithBackgroundLease makes the constructors succeed even if etcd can't be
+reached to grant the lease, after the attempts configured by WithInitRetry.
+The lease is then granted in the background, retrying with increasing delays
+until etcd becomes reachable or the exporter is closed. Until then, the
+exporter is not healthy and exporting ports fails with ErrNoLease, except in
+best-effort mode (see WithBestEffort), where ports are exported as soon as
+the lease has been granted. Errors other than failures to grant the lease,
+e.g. an invalid TTL, are still returned.
+*/
+func WithBackgroundLease() Option {
+	return func(e *ServiceExporter) {
+		e.backgroundLease = true
+	}
+}
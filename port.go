@@ -0,0 +1,45 @@
+package exportedservice
+
+import (
+	"net"
+	"strconv"
+)
+
+/*
+ListenerPort returns the port "l" is bound to, e.g. the one chosen by the
+operating system for a port requested as 0, so that it can be reported at
+startup without parsing l.Addr(). Returns 0 for listeners without a port,
+such as Unix domain sockets.
+*/
+func ListenerPort(l net.Listener) int {
+	var addr, ok = l.Addr().(*net.TCPAddr)
+	var port string
+	var rv int
+	var err error
+
+	if ok {
+		return addr.Port
+	}
+
+	if _, port, err = net.SplitHostPort(l.Addr().String()); err != nil {
+		return 0
+	}
+	if rv, err = strconv.Atoi(port); err != nil {
+		return 0
+	}
+
+	return rv
+}
+
+/*
+logBoundPort logs the port "l" was bound to for exporting it as "services",
+if it has one.
+*/
+func (e *ServiceExporter) logBoundPort(services []string, l net.Listener) {
+	var port = ListenerPort(l)
+
+	if port != 0 {
+		e.logf("exportedservice: bound %v to %s port %d", services,
+			l.Addr().Network(), port)
+	}
+}
@@ -0,0 +1,66 @@
+package exportedservice
+
+import (
+	"context"
+	"net"
+)
+
+/*
+Registration refers to a single port exported through a ServiceExporter, as
+returned by ExportPort. It allows removing exactly that port from etcd, even
+if several ports are exported under the same service name concurrently.
+*/
+type Registration struct {
+	e   *ServiceExporter
+	exp *export
+}
+
+/*
+ExportPort works like NewExportedPort, but additionally returns a handle for
+the registration, which can be used to unexport this specific port later.
+With WithBestEffort, the port can only be unexported through the handle once
+it has actually been written to etcd.
+*/
+func (e *ServiceExporter) ExportPort(
+	ctx context.Context, network, ip, service string, opts ...ExportOption) (
+	net.Listener, *Registration, error) {
+	var exp *export
+	var l net.Listener
+	var err error
+
+	l, exp, err = e.newExportedPort(ctx, network, ip, service, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return l, &Registration{e: e, exp: exp}, nil
+}
+
+/*
+Service returns the name the port was exported as.
+*/
+func (r *Registration) Service() string {
+	return r.exp.service
+}
+
+/*
+Key returns the etcd key the port is currently exported under. The key
+changes if the port is exported again with a new lease; see WithAutoReExport.
+*/
+func (r *Registration) Key() string {
+	r.e.mtx.Lock()
+	defer r.e.mtx.Unlock()
+
+	return r.e.exportPath(r.exp)
+}
+
+/*
+Unexport removes the port from etcd, along with its shadow registrations,
+leaving all other ports exported through the exporter in place. Returns the
+number of keys deleted, which is 0 if the port was already unexported.
+*/
+func (r *Registration) Unexport(ctx context.Context) (int64, error) {
+	return r.e.unexport(ctx, func(exp *export) bool {
+		return exp == r.exp || exp.shadowOf == r.exp
+	})
+}
@@ -0,0 +1,91 @@
+package exportedservice
+
+import (
+	"context"
+	"sort"
+
+	etcd "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataFunc extracts the gRPC metadata to attach to an outgoing etcd
+// request from its context; see WithRequestMetadata.
+type MetadataFunc func(ctx context.Context) map[string]string
+
+/*
+withRequestMetadata returns "ctx" with the metadata extracted by "f" added to
+the outgoing gRPC metadata.
+*/
+func withRequestMetadata(ctx context.Context, f MetadataFunc) context.Context {
+	var md = f(ctx)
+	var kv, keys []string
+	var k string
+
+	if len(md) == 0 {
+		return ctx
+	}
+
+	for k = range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k = range keys {
+		kv = append(kv, k, md[k])
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// metadataKV wraps an etcd.KV so that every request carries the gRPC
+// metadata extracted from its context.
+type metadataKV struct {
+	etcd.KV
+	f MetadataFunc
+}
+
+func (kv *metadataKV) Put(ctx context.Context, key, val string,
+	opts ...etcd.OpOption) (*etcd.PutResponse, error) {
+	return kv.KV.Put(withRequestMetadata(ctx, kv.f), key, val, opts...)
+}
+
+func (kv *metadataKV) Get(ctx context.Context, key string,
+	opts ...etcd.OpOption) (*etcd.GetResponse, error) {
+	return kv.KV.Get(withRequestMetadata(ctx, kv.f), key, opts...)
+}
+
+func (kv *metadataKV) Delete(ctx context.Context, key string,
+	opts ...etcd.OpOption) (*etcd.DeleteResponse, error) {
+	return kv.KV.Delete(withRequestMetadata(ctx, kv.f), key, opts...)
+}
+
+func (kv *metadataKV) Txn(ctx context.Context) etcd.Txn {
+	return kv.KV.Txn(withRequestMetadata(ctx, kv.f))
+}
+
+// metadataLease wraps an etcd.Lease so that every request carries the gRPC
+// metadata extracted from its context.
+type metadataLease struct {
+	etcd.Lease
+	f MetadataFunc
+}
+
+func (l *metadataLease) Grant(ctx context.Context, ttl int64) (
+	*etcd.LeaseGrantResponse, error) {
+	return l.Lease.Grant(withRequestMetadata(ctx, l.f), ttl)
+}
+
+func (l *metadataLease) Revoke(ctx context.Context, id etcd.LeaseID) (
+	*etcd.LeaseRevokeResponse, error) {
+	return l.Lease.Revoke(withRequestMetadata(ctx, l.f), id)
+}
+
+func (l *metadataLease) KeepAlive(ctx context.Context, id etcd.LeaseID) (
+	<-chan *etcd.LeaseKeepAliveResponse, error) {
+	return l.Lease.KeepAlive(withRequestMetadata(ctx, l.f), id)
+}
+
+func (l *metadataLease) KeepAliveOnce(ctx context.Context, id etcd.LeaseID) (
+	*etcd.LeaseKeepAliveResponse, error) {
+	return l.Lease.KeepAliveOnce(withRequestMetadata(ctx, l.f), id)
+}
@@ -0,0 +1,181 @@
+package exportedservice
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+/*
+servicePrefix returns the etcd key prefix under which all instances of
+"service" are exported.
+*/
+func (e *ServiceExporter) servicePrefix(service string) string {
+	return e.keyPrefix + "/" + service + "/"
+}
+
+/*
+endpointAddress extracts the address from an etcd value written by one of
+the export functions. This handles both plain host:port pairs and values
+written with metadata.
+*/
+func endpointAddress(value []byte) string {
+	var ep *Endpoint
+	var err error
+
+	if ep, err = ParseEndpoint(value); err != nil {
+		return string(value)
+	}
+
+	return ep.Addr
+}
+
+/*
+sortedAddresses returns the values of "endpoints" as a sorted list.
+*/
+func sortedAddresses(endpoints map[string]string) []string {
+	var rv = make([]string, 0, len(endpoints))
+	var addr string
+
+	for _, addr = range endpoints {
+		rv = append(rv, addr)
+	}
+
+	sort.Strings(rv)
+	return rv
+}
+
+/*
+ListService returns the addresses of all instances of "service" which are
+currently exported in etcd, using the same key layout as NewExportedPort.
+*/
+func (e *ServiceExporter) ListService(ctx context.Context, service string) (
+	[]string, error) {
+	var resp *etcd.GetResponse
+	var endpoints = make(map[string]string)
+	var kv *mvccpb.KeyValue
+	var err error
+
+	resp, err = e.kv.Get(ctx, e.servicePrefix(service), etcd.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kv = range resp.Kvs {
+		endpoints[string(kv.Key)] = endpointAddress(kv.Value)
+	}
+
+	return sortedAddresses(endpoints), nil
+}
+
+/*
+WatchService lists the addresses of all instances of "service" exported in
+etcd and watches for changes. The current list of addresses is sent on the
+returned channel initially and whenever an instance appears or disappears.
+The channel is closed once "ctx" is cancelled or the watch fails.
+*/
+func (e *ServiceExporter) WatchService(ctx context.Context, service string) (
+	<-chan []string, error) {
+	var resp *etcd.GetResponse
+	var endpoints = make(map[string]string)
+	var prefix = e.servicePrefix(service)
+	var watch etcd.WatchChan
+	var rv = make(chan []string, 1)
+	var kv *mvccpb.KeyValue
+	var err error
+
+	if resp, err = e.kv.Get(ctx, prefix, etcd.WithPrefix()); err != nil {
+		return nil, err
+	}
+
+	for _, kv = range resp.Kvs {
+		endpoints[string(kv.Key)] = endpointAddress(kv.Value)
+	}
+
+	// Only watch for changes after the state we just read.
+	watch = e.watcher.Watch(ctx, prefix, etcd.WithPrefix(),
+		etcd.WithRev(resp.Header.Revision+1))
+
+	rv <- sortedAddresses(endpoints)
+
+	go func() {
+		var wresp etcd.WatchResponse
+		var ev *etcd.Event
+
+		defer close(rv)
+
+		for wresp = range watch {
+			if wresp.Err() != nil {
+				return
+			}
+
+			for _, ev = range wresp.Events {
+				switch ev.Type {
+				case etcd.EventTypePut:
+					endpoints[string(ev.Kv.Key)] = endpointAddress(ev.Kv.Value)
+				case etcd.EventTypeDelete:
+					delete(endpoints, string(ev.Kv.Key))
+				}
+			}
+
+			select {
+			case rv <- sortedAddresses(endpoints):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return rv, nil
+}
+
+/*
+DialService connects to a random instance of "service" among those currently
+exported in etcd. If connecting to an instance fails, the remaining instances
+are tried in random order. Any scheme prefix of the exported address, such as
+"https://", is stripped before dialing.
+*/
+func (e *ServiceExporter) DialService(
+	ctx context.Context, network, service string) (net.Conn, error) {
+	var dialer net.Dialer
+	var addrs []string
+	var conn net.Conn
+	var i int
+	var err error
+
+	if addrs, err = e.ListService(ctx, service); err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no instances of " + service + " exported")
+	}
+
+	for _, i = range rand.Perm(len(addrs)) {
+		conn, err = dialer.DialContext(ctx, network, stripScheme(addrs[i]))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+/*
+stripScheme removes a "scheme://" prefix from "addr", if present.
+*/
+func stripScheme(addr string) string {
+	var i = strings.Index(addr, "://")
+
+	if i < 0 {
+		return addr
+	}
+
+	return addr[i+3:]
+}
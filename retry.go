@@ -0,0 +1,81 @@
+package exportedservice
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults for retrying writes which etcd rejected with a transient error;
+// see WithWriteRetry.
+const (
+	defaultWriteAttempts = 5
+	defaultWriteBackoff  = 100 * time.Millisecond
+)
+
+/*
+isRetriable returns true if "err" is a transient etcd error, such as one
+caused by a leader election in progress, after which the write can be tried
+again.
+*/
+func isRetriable(err error) bool {
+	var coded interface{ Code() codes.Code }
+	var s *status.Status
+	var ok bool
+
+	if errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// Errors known to etcd are translated into rpctypes.EtcdError.
+	if errors.As(err, &coded) {
+		return coded.Code() == codes.Unavailable
+	}
+
+	if s, ok = status.FromError(err); ok {
+		return s.Code() == codes.Unavailable
+	}
+
+	return false
+}
+
+/*
+commitTxn commits "txn", which is rebuilt for every attempt, and retries with
+exponential backoff as long as etcd rejects it with a transient error, up to
+the configured number of attempts or until "ctx" is done.
+*/
+func (e *ServiceExporter) commitTxn(ctx context.Context,
+	txn func() etcd.Txn) (*etcd.TxnResponse, error) {
+	var attempts = defaultWriteAttempts
+	var delay = defaultWriteBackoff
+	var resp *etcd.TxnResponse
+	var attempt int
+	var err error
+
+	if e.writeAttempts > 0 {
+		attempts = e.writeAttempts
+		delay = e.writeBackoff
+	}
+
+	for attempt = 1; ; attempt++ {
+		resp, err = txn().Commit()
+		if err == nil || !isRetriable(err) || attempt >= attempts {
+			return resp, err
+		}
+
+		e.logf("exportedservice: retrying write after transient error: %s",
+			err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
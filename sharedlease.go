@@ -0,0 +1,214 @@
+package exportedservice
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+/*
+NewExporterWithLease creates a new exporter which exports ports using the
+existing lease "lease" instead of granting one of its own, e.g. one shared by
+several subsystems of an application, so that all their registrations expire
+together. Renewing the lease is up to its owner; see NewExporterSharingLease
+for sharing the lease of another exporter.
+
+"keepalive" is the channel returned by etcd.Lease.KeepAlive for the lease,
+which the exporter then consumes to track the health of the lease, like its
+own. If it is nil, the exporter instead asks etcd for the remaining TTL of
+the lease about three times per TTL. Either way, the loss of the lease is
+reported through Err and IsHealthy.
+
+Close and DeregisterAll remove the exported keys, but neither revoke the
+lease nor close "client", which may be shared as well.
+*/
+func NewExporterWithLease(ctx context.Context, client *etcd.Client,
+	lease etcd.LeaseID, keepalive <-chan *etcd.LeaseKeepAliveResponse,
+	opts ...Option) (*ServiceExporter, error) {
+	var rv = newServiceExporter(client, opts)
+	var err error
+
+	if err = rv.initBorrowedLease(ctx, lease); err != nil {
+		return rv, err
+	}
+
+	rv.consumers.Add(1)
+	if keepalive != nil {
+		go rv.watchBorrowedLease(keepalive)
+	} else {
+		go rv.pollBorrowedLease()
+	}
+
+	return rv, nil
+}
+
+/*
+NewExporterSharingLease creates a new exporter which exports ports using the
+lease of the exporter "primary" and its etcd client, so that both hold only a
+single lease between them, renewed by "primary". The new exporter is healthy
+as long as "primary" is, and its ports disappear from etcd along with the
+lease of "primary". Should "primary" re-export its ports with a new lease
+(see WithAutoReExport), the ports of the new exporter are not moved along.
+*/
+func NewExporterSharingLease(ctx context.Context, primary *ServiceExporter,
+	opts ...Option) (*ServiceExporter, error) {
+	var rv = newServiceExporter(primary.Client(), opts)
+
+	rv.primary = primary
+
+	return rv, rv.initBorrowedLease(ctx, primary.LeaseID())
+}
+
+/*
+initBorrowedLease makes the exporter use the lease "lease" owned by someone
+else, after checking that it is still alive.
+*/
+func (e *ServiceExporter) initBorrowedLease(
+	ctx context.Context, lease etcd.LeaseID) error {
+	var resp *etcd.LeaseTimeToLiveResponse
+	var err error
+
+	if lease == etcd.NoLease {
+		return ErrNoLease
+	}
+
+	if resp, err = e.lease.TimeToLive(ctx, lease); err != nil {
+		return &LeaseError{Kind: ErrLeaseKeepaliveFailed, ID: lease, Err: err}
+	}
+	if resp.TTL <= 0 {
+		return &LeaseError{Kind: ErrLeaseKeepaliveFailed, ID: lease,
+			Err: errors.New("lease has expired")}
+	}
+
+	e.keepaliveCtx, e.cancelKeepalive = context.WithCancel(
+		context.Background())
+	e.borrowedLease = true
+	e.leaseID = lease
+	e.ttl = resp.GrantedTTL
+	e.grantedTTL = resp.GrantedTTL
+	e.lastKeepalive = time.Now()
+	e.reportedTTL = resp.TTL
+	e.renewing = true
+
+	e.logf("exportedservice: using shared lease %016x with ttl %d",
+		e.leaseID, e.ttl)
+
+	if e.refreshInterval > 0 {
+		e.consumers.Add(1)
+		go e.refreshExports(e.keepaliveCtx)
+	}
+
+	if e.endpointSyncInterval > 0 && e.conn != nil {
+		e.consumers.Add(1)
+		go e.syncEndpoints(e.keepaliveCtx)
+	}
+
+	return nil
+}
+
+/*
+watchBorrowedLease records the keepalive responses for the borrowed lease
+from "ch", until it is closed or the exporter is closed.
+*/
+func (e *ServiceExporter) watchBorrowedLease(
+	ch <-chan *etcd.LeaseKeepAliveResponse) {
+	var resp *etcd.LeaseKeepAliveResponse
+	var ok bool
+
+	defer e.consumers.Done()
+
+	for {
+		select {
+		case <-e.keepaliveCtx.Done():
+			return
+		case resp, ok = <-ch:
+		}
+		if !ok {
+			break
+		}
+
+		e.mtx.Lock()
+		e.metrics.LeaseRenewed(time.Since(e.lastKeepalive))
+		e.lastKeepalive = time.Now()
+		e.reportedTTL = resp.TTL
+		e.renewals++
+		e.mtx.Unlock()
+
+		e.emit(Event{Type: EventLeaseRenewed, LeaseID: resp.ID})
+	}
+
+	e.borrowedLeaseLost()
+}
+
+/*
+pollBorrowedLease asks etcd for the remaining TTL of the borrowed lease about
+three times per TTL, until the lease has expired or the exporter is closed.
+*/
+func (e *ServiceExporter) pollBorrowedLease() {
+	var ticker *time.Ticker
+	var resp *etcd.LeaseTimeToLiveResponse
+	var lease etcd.LeaseID
+	var expired bool
+	var err error
+
+	defer e.consumers.Done()
+
+	e.mtx.Lock()
+	lease = e.leaseID
+	ticker = time.NewTicker(time.Duration(e.grantedTTL) * time.Second / 3)
+	e.mtx.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.keepaliveCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		resp, err = e.lease.TimeToLive(e.keepaliveCtx, lease)
+
+		e.mtx.Lock()
+		if err == nil && resp.TTL > 0 {
+			e.lastKeepalive = time.Now()
+			e.reportedTTL = resp.TTL
+		} else if err != nil {
+			e.missedRenewals++
+		}
+		// Give up once the lease is gone, or must have expired by now.
+		expired = (err == nil && resp.TTL <= 0) ||
+			time.Since(e.lastKeepalive) >=
+				time.Duration(e.reportedTTL)*time.Second
+		e.mtx.Unlock()
+
+		if expired {
+			e.borrowedLeaseLost()
+			return
+		}
+	}
+}
+
+/*
+borrowedLeaseLost reports that the borrowed lease is no longer alive, unless
+the exporter is being closed.
+*/
+func (e *ServiceExporter) borrowedLeaseLost() {
+	e.mtx.Lock()
+	if e.keepaliveCtx.Err() != nil {
+		e.mtx.Unlock()
+		return
+	}
+	e.renewing = false
+	e.logf("exportedservice: shared lease %016x lost", e.leaseID)
+	e.emit(Event{Type: EventLeaseLost, LeaseID: e.leaseID})
+	e.mtx.Unlock()
+
+	e.metrics.KeepaliveFailed()
+
+	select {
+	case e.errors <- ErrKeepaliveLost:
+	default:
+	}
+}
@@ -0,0 +1,80 @@
+package exportedservice
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// signalDeregisterTimeout bounds how long UnexportOnSignal waits for etcd
+// before passing the signal on, so that an unreachable etcd doesn't keep the
+// process from exiting.
+const signalDeregisterTimeout = 5 * time.Second
+
+/*
+UnexportOnSignal calls DeregisterAll as soon as one of "sigs" is received, so
+exported ports are removed from etcd rather than waiting for the lease to
+expire. Afterwards the signal is delivered to the process again, so that its
+default action (e.g. terminating on SIGTERM) still takes effect, even if etcd
+couldn't be reached within a few seconds. If no signals are given, SIGTERM and
+os.Interrupt are watched.
+
+UnexportOnSignal is meant for applications which don't handle these signals
+themselves: handlers installed with signal.Notify would see the signal twice.
+Applications with their own handlers should call DeregisterAll from there
+instead.
+
+The returned function stops watching for the signals; it should be called if
+the application wants to opt out again.
+*/
+func (e *ServiceExporter) UnexportOnSignal(sigs ...os.Signal) func() {
+	var ch = make(chan os.Signal, 1)
+	var stop = make(chan struct{})
+	var once sync.Once
+
+	// signal.Notify would relay all signals otherwise, including those
+	// used by the runtime such as SIGURG.
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		var ctx context.Context
+		var cancel context.CancelFunc
+		var proc *os.Process
+		var sig os.Signal
+		var err error
+
+		select {
+		case sig = <-ch:
+		case <-stop:
+			return
+		}
+
+		signal.Stop(ch)
+
+		ctx, cancel = context.WithTimeout(context.Background(),
+			signalDeregisterTimeout)
+		if err = e.DeregisterAll(ctx); err != nil {
+			e.logf("exportedservice: deregistering on %s: %s", sig, err)
+		}
+		cancel()
+
+		// Pass the signal on now that we're done.
+		if proc, err = os.FindProcess(os.Getpid()); err == nil {
+			proc.Signal(sig)
+		}
+	}()
+
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(stop)
+		})
+	}
+}
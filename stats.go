@@ -0,0 +1,51 @@
+package exportedservice
+
+import (
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// ExporterStats is a snapshot of the lease renewal activity of an exporter,
+// as returned by ServiceExporter.Stats.
+type ExporterStats struct {
+	// Renewals is the number of keepalive responses received from etcd.
+	Renewals int64
+
+	// MissedRenewals is the number of times renewing the lease failed,
+	// e.g. because the keepalive stream was interrupted, including failed
+	// attempts at resuming renewal.
+	MissedRenewals int64
+
+	// SinceLastRenewal is the time passed since the lease was last renewed
+	// or granted.
+	SinceLastRenewal time.Duration
+
+	// LeaseID is the lease currently held by the exporter, or NoLease.
+	LeaseID etcd.LeaseID
+}
+
+/*
+Stats returns the current lease renewal statistics of the exporter, e.g. for
+a debug page. This is a lightweight alternative to WithMetrics.
+*/
+func (e *ServiceExporter) Stats() ExporterStats {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	return ExporterStats{
+		Renewals:         e.renewals,
+		MissedRenewals:   e.missedRenewals,
+		SinceLastRenewal: time.Since(e.lastKeepalive),
+		LeaseID:          e.leaseID,
+	}
+}
+
+/*
+missedRenewal records a failure to renew the lease.
+*/
+func (e *ServiceExporter) missedRenewal() {
+	e.mtx.Lock()
+	e.missedRenewals++
+	e.mtx.Unlock()
+}
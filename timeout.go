@@ -0,0 +1,137 @@
+package exportedservice
+
+import (
+	"context"
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// timeoutKV wraps an etcd.KV so that every operation times out after a fixed
+// duration, regardless of the deadline of the context passed in.
+type timeoutKV struct {
+	etcd.KV
+	timeout time.Duration
+}
+
+func (kv *timeoutKV) Put(ctx context.Context, key, val string,
+	opts ...etcd.OpOption) (*etcd.PutResponse, error) {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, kv.timeout)
+	defer cancel()
+
+	return kv.KV.Put(ctx, key, val, opts...)
+}
+
+func (kv *timeoutKV) Get(ctx context.Context, key string,
+	opts ...etcd.OpOption) (*etcd.GetResponse, error) {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, kv.timeout)
+	defer cancel()
+
+	return kv.KV.Get(ctx, key, opts...)
+}
+
+func (kv *timeoutKV) Delete(ctx context.Context, key string,
+	opts ...etcd.OpOption) (*etcd.DeleteResponse, error) {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, kv.timeout)
+	defer cancel()
+
+	return kv.KV.Delete(ctx, key, opts...)
+}
+
+func (kv *timeoutKV) Txn(ctx context.Context) etcd.Txn {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, kv.timeout)
+
+	return &timeoutTxn{Txn: kv.KV.Txn(ctx), cancel: cancel}
+}
+
+// timeoutTxn releases the timeout context of a transaction once it has been
+// committed.
+type timeoutTxn struct {
+	etcd.Txn
+	cancel context.CancelFunc
+}
+
+func (t *timeoutTxn) If(cs ...etcd.Cmp) etcd.Txn {
+	t.Txn = t.Txn.If(cs...)
+	return t
+}
+
+func (t *timeoutTxn) Then(ops ...etcd.Op) etcd.Txn {
+	t.Txn = t.Txn.Then(ops...)
+	return t
+}
+
+func (t *timeoutTxn) Else(ops ...etcd.Op) etcd.Txn {
+	t.Txn = t.Txn.Else(ops...)
+	return t
+}
+
+func (t *timeoutTxn) Commit() (*etcd.TxnResponse, error) {
+	defer t.cancel()
+	return t.Txn.Commit()
+}
+
+// timeoutLease wraps an etcd.Lease so that every one-shot operation times out
+// after a fixed duration. KeepAlive is long-running and passed through as is.
+type timeoutLease struct {
+	etcd.Lease
+	timeout time.Duration
+}
+
+func (l *timeoutLease) Grant(ctx context.Context, ttl int64) (
+	*etcd.LeaseGrantResponse, error) {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	return l.Lease.Grant(ctx, ttl)
+}
+
+func (l *timeoutLease) Revoke(ctx context.Context, id etcd.LeaseID) (
+	*etcd.LeaseRevokeResponse, error) {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	return l.Lease.Revoke(ctx, id)
+}
+
+func (l *timeoutLease) KeepAliveOnce(ctx context.Context, id etcd.LeaseID) (
+	*etcd.LeaseKeepAliveResponse, error) {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	return l.Lease.KeepAliveOnce(ctx, id)
+}
+
+func (l *timeoutLease) TimeToLive(ctx context.Context, id etcd.LeaseID,
+	opts ...etcd.LeaseOption) (*etcd.LeaseTimeToLiveResponse, error) {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	return l.Lease.TimeToLive(ctx, id, opts...)
+}
+
+func (l *timeoutLease) Leases(ctx context.Context) (
+	*etcd.LeaseLeasesResponse, error) {
+	var cancel context.CancelFunc
+
+	ctx, cancel = context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	return l.Lease.Leases(ctx)
+}
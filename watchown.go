@@ -0,0 +1,212 @@
+package exportedservice
+
+import (
+	"context"
+	"sync"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+/*
+WatchOwnKey watches the keys of all ports exported through this exporter,
+including their shadow registrations (see WithShadowPrefix), and delivers the
+key through the returned channel whenever one of them is deleted or
+overwritten by someone else, e.g. by an operator or a misbehaving tool, while
+the port is still exported. If "reput" is set, the original value is written
+back to etcd right away, so the registration heals itself. Ports exported
+after the call are watched as well.
+
+Removing a port through UnexportPort or Close is not reported, and neither
+are keys which disappear because their lease expired. The channel is closed
+once "ctx" is cancelled, the exporter is closed or the watch fails.
+*/
+func (e *ServiceExporter) WatchOwnKey(
+	ctx context.Context, reput bool) <-chan string {
+	var rv = make(chan string, 1)
+
+	go e.watchOwnKeys(ctx, reput, rv)
+
+	return rv
+}
+
+/*
+watchOwnKeys implements WatchOwnKey: it keeps one watch for each exported
+key, starting and stopping them as ports are exported and unexported, and
+delivers the keys modified externally through "rv".
+*/
+func (e *ServiceExporter) watchOwnKeys(
+	ctx context.Context, reput bool, rv chan<- string) {
+	var watches = make(map[string]context.CancelFunc)
+	var events = make(chan *etcd.Event)
+	var failed = make(chan struct{}, 1)
+	var changed <-chan struct{}
+	var keys map[string]bool
+	var cancel context.CancelFunc
+	var wg sync.WaitGroup
+	var ev *etcd.Event
+	var closed bool
+	var key string
+
+	defer close(rv)
+	defer wg.Wait()
+	defer func() {
+		for _, cancel = range watches {
+			cancel()
+		}
+	}()
+
+	for {
+		e.mtx.Lock()
+		closed = e.closed
+		keys = make(map[string]bool)
+		for key = range e.exports {
+			keys[key] = true
+		}
+		if e.exportsChanged == nil {
+			e.exportsChanged = make(chan struct{})
+		}
+		changed = e.exportsChanged
+		e.mtx.Unlock()
+
+		if closed {
+			return
+		}
+
+		for key = range keys {
+			if watches[key] == nil {
+				watches[key] = e.watchKey(ctx, key, events, failed, &wg)
+			}
+		}
+		for key, cancel = range watches {
+			if !keys[key] {
+				cancel()
+				delete(watches, key)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-failed:
+			return
+		case <-changed:
+		case ev = <-events:
+			if !e.checkOwnKey(ctx, ev, reput) {
+				continue
+			}
+
+			select {
+			case rv <- string(ev.Kv.Key):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+/*
+watchKey starts watching "key", passing its events on to "events" until the
+returned function is called or "ctx" is done. If the watch fails, "failed"
+is signalled.
+*/
+func (e *ServiceExporter) watchKey(ctx context.Context, key string,
+	events chan<- *etcd.Event, failed chan<- struct{},
+	wg *sync.WaitGroup) context.CancelFunc {
+	var cancel context.CancelFunc
+	var watch etcd.WatchChan
+
+	// The previous value tells us the lease of deleted keys.
+	ctx, cancel = context.WithCancel(ctx)
+	watch = e.watcher.Watch(ctx, key, etcd.WithPrevKV())
+
+	wg.Add(1)
+	go func() {
+		var wresp etcd.WatchResponse
+		var ev *etcd.Event
+
+		defer wg.Done()
+
+		for wresp = range watch {
+			if wresp.Err() != nil {
+				if ctx.Err() == nil {
+					select {
+					case failed <- struct{}{}:
+					default:
+					}
+				}
+				return
+			}
+
+			for _, ev = range wresp.Events {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return cancel
+}
+
+/*
+notifyExports wakes up all watches started by WatchOwnKey, so they pick up
+new keys. The caller must hold the lock.
+*/
+func (e *ServiceExporter) notifyExports() {
+	if e.exportsChanged != nil {
+		close(e.exportsChanged)
+		e.exportsChanged = nil
+	}
+}
+
+/*
+checkOwnKey returns true if the watch event "ev" deletes or modifies one of
+the keys exported through this exporter, other than by the expiry of its
+lease. If "reput" is set, the exported value is written back. The lock is not
+held while talking to etcd.
+*/
+func (e *ServiceExporter) checkOwnKey(
+	ctx context.Context, ev *etcd.Event, reput bool) bool {
+	var path = string(ev.Kv.Key)
+	var resp *etcd.LeaseTimeToLiveResponse
+	var lease etcd.LeaseID
+	var exp *export
+	var value string
+	var ok bool
+	var err error
+
+	e.mtx.Lock()
+	if e.closed {
+		e.mtx.Unlock()
+		return false
+	}
+
+	// Our own writes carry the value we recorded.
+	if exp, ok = e.exports[path]; !ok ||
+		(ev.Type == etcd.EventTypePut && string(ev.Kv.Value) == exp.value) {
+		e.mtx.Unlock()
+		return false
+	}
+	value = exp.value
+	lease = e.exportLease(exp)
+	e.mtx.Unlock()
+
+	// Keys disappear by themselves once their lease expires.
+	if ev.Type == etcd.EventTypeDelete && ev.PrevKv != nil &&
+		ev.PrevKv.Lease != 0 {
+		resp, err = e.lease.TimeToLive(ctx, etcd.LeaseID(ev.PrevKv.Lease))
+		if err == nil && resp.TTL <= 0 {
+			return false
+		}
+	}
+
+	e.logf("exportedservice: key %s was modified externally", path)
+
+	if reput {
+		e.kv.Put(ctx, path, value, etcd.WithLease(lease))
+	}
+
+	return true
+}
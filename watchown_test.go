@@ -0,0 +1,80 @@
+package exportedservice
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+func TestWatchOwnKeyReportsAndRestoresDeletion(t *testing.T) {
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	var client *etcd.Client
+	var e *ServiceExporter
+	var l net.Listener
+	var resp *etcd.GetResponse
+	var changed <-chan string
+	var endpoints []string
+	var path, key string
+	var ok bool
+	var err error
+
+	defer cancel()
+
+	_, endpoints = startEtcd(t, 1)
+
+	if e, err = NewExporter(ctx, endpoints[0], 5); err != nil {
+		t.Fatalf("NewExporter() = %v", err)
+	}
+	defer e.Close(context.Background())
+
+	if l, err = e.NewExportedPort(ctx, "tcp", "127.0.0.1", "test"); err != nil {
+		t.Fatalf("NewExportedPort() = %v", err)
+	}
+	defer l.Close()
+
+	if path, ok = e.ExportedPath("test"); !ok {
+		t.Fatal("ExportedPath() found no export")
+	}
+
+	client, err = etcd.New(etcd.Config{Endpoints: endpoints})
+	if err != nil {
+		t.Fatalf("etcd.New() = %v", err)
+	}
+	defer client.Close()
+
+	changed = e.WatchOwnKey(ctx, true)
+
+	// Keys of other services are none of our business.
+	if _, err = client.Put(ctx, DefaultKeyPrefix+"/other/x", "y"); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+
+	// The watch is set up in the background, so keep deleting until the
+	// deletion is noticed.
+	for key == "" {
+		if _, err = client.Delete(ctx, path); err != nil {
+			t.Fatalf("Delete() = %v", err)
+		}
+
+		select {
+		case key = <-changed:
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("deletion of our key was never reported")
+		}
+	}
+
+	if key != path {
+		t.Errorf("WatchOwnKey() reported %q, want %q", key, path)
+	}
+
+	if resp, err = client.Get(ctx, path); err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Errorf("key %s was not written back", path)
+	}
+}